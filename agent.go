@@ -0,0 +1,476 @@
+package cryptostack
+
+import (
+	"bufio"
+	"bytes"
+	stded25519 "crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ArtemKulyabin/cryptostack/internal/secmem"
+	"golang.org/x/crypto/curve25519"
+)
+
+// AgentSockEnv names the environment variable with the path of the agent
+// socket. When it is set, Signature.Sign and Skey.OpenSealed use the agent
+// for locked keys.
+const AgentSockEnv = "CRYPTOSTACK_AGENT_SOCK"
+
+// Agent keeps unlocked secret keys in memory and uses them on behalf of
+// clients, like ssh-agent. Secret keys never leave the agent.
+type Agent struct {
+	// Confirm is asked before a key added with confirm is used, op is
+	// "sign" or "decrypt". Without Confirm such keys can't be used.
+	Confirm func(pkey *Pkey, op string) bool
+
+	mu       sync.Mutex
+	keys     map[string]*agentKey
+	lockSalt []byte
+	lockHash []byte
+}
+
+type agentKey struct {
+	// mu is held for reading while skey is used, removing the key wipes
+	// skey under the write lock.
+	mu      sync.RWMutex
+	skey    *Skey
+	expires time.Time
+	confirm bool
+	timer   *time.Timer
+}
+
+func NewAgent() *Agent {
+	return &Agent{keys: map[string]*agentKey{}}
+}
+
+// Add stores a copy of an unlocked skey, replacing a key with the same ID.
+// A non-zero lifetime removes the key once it has passed, removed keys are
+// wiped.
+func (a *Agent) Add(skey *Skey, lifetime time.Duration, confirm bool) error {
+	if skey.edSkey == nil || skey.curveSkey == nil || skey.pkey == nil {
+		return errors.New("Key is locked")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockHash != nil {
+		return ErrAgentLocked
+	}
+	id := string(skey.ID)
+	a.remove(id)
+	c := &Skey{Alg: skey.Alg, ID: skey.ID, Meta: skey.Meta, pkey: skey.pkey}
+	c.setSecret(skey.GetCurveKey(), skey.GetEdKey())
+	key := &agentKey{skey: c, confirm: confirm}
+	if lifetime > 0 {
+		key.expires = time.Now().Add(lifetime)
+		key.timer = time.AfterFunc(lifetime, func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if a.keys[id] == key {
+				a.remove(id)
+			}
+		})
+	}
+	a.keys[id] = key
+	return nil
+}
+
+func (a *Agent) Remove(id []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockHash != nil {
+		return ErrAgentLocked
+	}
+	if _, ok := a.keys[string(id)]; !ok {
+		return ErrKeyNotFound
+	}
+	a.remove(string(id))
+	return nil
+}
+
+func (a *Agent) RemoveAll() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockHash != nil {
+		return ErrAgentLocked
+	}
+	for id := range a.keys {
+		a.remove(id)
+	}
+	return nil
+}
+
+func (a *Agent) remove(id string) {
+	if key, ok := a.keys[id]; ok {
+		if key.timer != nil {
+			key.timer.Stop()
+		}
+		delete(a.keys, id)
+		key.mu.Lock()
+		key.skey.Wipe()
+		key.mu.Unlock()
+	}
+}
+
+// List returns the public keys held by the agent, sorted by ID.
+func (a *Agent) List() ([]*Pkey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockHash != nil {
+		return nil, ErrAgentLocked
+	}
+	var list []*Pkey
+	for _, key := range a.keys {
+		list = append(list, key.skey.GetPkey())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return bytes.Compare(list[i].ID, list[j].ID) < 0
+	})
+	return list, nil
+}
+
+// Lock refuses every operation but Unlock until it is called with the same
+// passphrase. Keys and their lifetimes are kept.
+func (a *Agent) Lock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockHash != nil {
+		return ErrAgentLocked
+	}
+	a.lockSalt = make([]byte, 32)
+	_, err := rand.Read(a.lockSalt)
+	if err != nil {
+		return err
+	}
+	a.lockHash = agentLockHash(a.lockSalt, passphrase)
+	return nil
+}
+
+func (a *Agent) Unlock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockHash == nil {
+		return errors.New("Agent is not locked")
+	}
+	if subtle.ConstantTimeCompare(a.lockHash, agentLockHash(a.lockSalt, passphrase)) != 1 {
+		return errors.New("Wrong passphrase")
+	}
+	a.lockHash, a.lockSalt = nil, nil
+	return nil
+}
+
+func agentLockHash(salt, passphrase []byte) []byte {
+	sum := sha512.Sum512(append(append([]byte{}, salt...), passphrase...))
+	return sum[:]
+}
+
+// Sign signs message for ContextFile.
+func (a *Agent) Sign(id []byte, message []byte) ([]byte, error) {
+	return a.SignWithContext(id, message, SigAlgEd25519ctx, ContextFile)
+}
+
+// SignWithContext signs with Skey.SignWithContext. Pure ed25519 is refused,
+// so the agent can't be made to sign messages of another protocol.
+func (a *Agent) SignWithContext(id []byte, message []byte, alg string, context string) ([]byte, error) {
+	if alg != SigAlgEd25519ctx && alg != SigAlgEd25519ph {
+		return nil, ErrAgentPure
+	}
+	key, err := a.use(id, "sign")
+	if err != nil {
+		return nil, err
+	}
+	defer key.mu.RUnlock()
+	return key.skey.SignWithContext(message, alg, context)
+}
+
+func (a *Agent) OpenSealed(id []byte, sealed []byte) ([]byte, error) {
+	key, err := a.use(id, "decrypt")
+	if err != nil {
+		return nil, err
+	}
+	defer key.mu.RUnlock()
+	return key.skey.OpenSealed(sealed)
+}
+
+// use returns the key with id, read locked, after checking the lock,
+// lifetime and confirmation. Confirm is called without holding the lock, it
+// may take a while.
+func (a *Agent) use(id []byte, op string) (*agentKey, error) {
+	a.mu.Lock()
+	if a.lockHash != nil {
+		a.mu.Unlock()
+		return nil, ErrAgentLocked
+	}
+	key, ok := a.keys[string(id)]
+	if ok && !key.expires.IsZero() && !time.Now().Before(key.expires) {
+		a.remove(string(id))
+		ok = false
+	}
+	a.mu.Unlock()
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if key.confirm && (a.Confirm == nil || !a.Confirm(key.skey.GetPkey(), op)) {
+		return nil, ErrNotConfirmed
+	}
+	key.mu.RLock()
+	if !key.skey.unlocked() {
+		// Removed while confirming.
+		key.mu.RUnlock()
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// The protocol is a json request line answered by a json response line,
+// any number of times per connection.
+type agentRequest struct {
+	Op         string       `json:"op"`
+	ID         []byte       `json:"id,omitempty"`
+	Data       []byte       `json:"data,omitempty"`
+	Key        *agentKeyMsg `json:"key,omitempty"`
+	Lifetime   int64        `json:"lifetime,omitempty"`
+	Confirm    bool         `json:"confirm,omitempty"`
+	Passphrase []byte       `json:"passphrase,omitempty"`
+	Alg        string       `json:"alg,omitempty"`
+	Context    string       `json:"context,omitempty"`
+}
+
+type agentKeyMsg struct {
+	Pkey  *Pkey  `json:"pkey"`
+	Curve []byte `json:"curve"`
+	Ed    []byte `json:"ed"`
+}
+
+type agentResponse struct {
+	Error string  `json:"error,omitempty"`
+	Data  []byte  `json:"data,omitempty"`
+	Keys  []*Pkey `json:"keys,omitempty"`
+}
+
+// Serve answers clients connecting to l until l is closed.
+func (a *Agent) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go a.serveConn(conn)
+	}
+}
+
+func (a *Agent) serveConn(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+	for {
+		req := agentRequest{}
+		if dec.Decode(&req) != nil {
+			return
+		}
+		resp := agentResponse{}
+		var err error
+		switch req.Op {
+		case "add":
+			var skey *Skey
+			skey, err = req.Key.skey()
+			if err == nil {
+				err = a.Add(skey, time.Duration(req.Lifetime)*time.Second, req.Confirm)
+			}
+		case "remove":
+			err = a.Remove(req.ID)
+		case "removeall":
+			err = a.RemoveAll()
+		case "list":
+			resp.Keys, err = a.List()
+		case "lock":
+			err = a.Lock(req.Passphrase)
+		case "unlock":
+			err = a.Unlock(req.Passphrase)
+		case "sign":
+			resp.Data, err = a.SignWithContext(req.ID, req.Data, req.Alg, req.Context)
+		case "decrypt":
+			resp.Data, err = a.OpenSealed(req.ID, req.Data)
+		default:
+			err = errors.New("Unknown agent request")
+		}
+		if err != nil {
+			resp = agentResponse{Error: err.Error()}
+		}
+		if enc.Encode(resp) != nil {
+			return
+		}
+	}
+}
+
+func (msg *agentKeyMsg) skey() (*Skey, error) {
+	if msg == nil || msg.Pkey == nil || len(msg.Curve) != 32 || len(msg.Ed) != 64 {
+		return nil, errors.New("Bad agent key")
+	}
+	pkey := msg.Pkey
+	wantCurve := pkey.GetCurveKey()
+	curvePkey, err := curve25519.X25519(msg.Curve, curve25519.Basepoint)
+	if err != nil || wantCurve == nil || !bytes.Equal(curvePkey, wantCurve[:]) ||
+		!bytes.Equal(stded25519.NewKeyFromSeed(msg.Ed[:32]), msg.Ed) || !bytes.Equal(msg.Ed[32:], pkey.Ed.Pkey) {
+		return nil, errors.New("Secret key doesn't match public key")
+	}
+	curveSkey, edSkey := &[32]byte{}, &[64]byte{}
+	copy(curveSkey[:], msg.Curve)
+	copy(edSkey[:], msg.Ed)
+	secmem.Wipe(msg.Curve)
+	secmem.Wipe(msg.Ed)
+	skey := &Skey{Alg: pkey.Alg, ID: pkey.ID, pkey: pkey}
+	skey.setSecret(curveSkey, edSkey)
+	return skey, nil
+}
+
+// AgentClient talks to an agent over its Unix socket. It is safe for
+// concurrent use.
+type AgentClient struct {
+	mu   sync.Mutex
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+func DialAgent(path string) (*AgentClient, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &AgentClient{conn: conn, dec: json.NewDecoder(bufio.NewReader(conn)), enc: json.NewEncoder(conn)}, nil
+}
+
+// AgentFromEnv connects to the agent named by AgentSockEnv, or fails with
+// ErrNoAgent if it is not set.
+func AgentFromEnv() (*AgentClient, error) {
+	path := os.Getenv(AgentSockEnv)
+	if path == "" {
+		return nil, ErrNoAgent
+	}
+	return DialAgent(path)
+}
+
+func (c *AgentClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *AgentClient) call(req agentRequest) (*agentResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.enc.Encode(req)
+	if err != nil {
+		return nil, err
+	}
+	resp := &agentResponse{}
+	err = c.dec.Decode(resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, agentError(resp.Error)
+	}
+	return resp, nil
+}
+
+// agentError maps error messages of the agent back to the package errors.
+func agentError(msg string) error {
+	for _, err := range []error{ErrKeyNotFound, ErrAgentLocked, ErrNotConfirmed, ErrAgentPure} {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+// Add sends an unlocked skey to the agent.
+func (c *AgentClient) Add(skey *Skey, lifetime time.Duration, confirm bool) error {
+	if skey.edSkey == nil || skey.curveSkey == nil || skey.pkey == nil {
+		return errors.New("Key is locked")
+	}
+	if lifetime > 0 && lifetime < time.Second {
+		return errors.New("Lifetime is shorter than a second")
+	}
+	_, err := c.call(agentRequest{
+		Op:       "add",
+		Key:      &agentKeyMsg{Pkey: skey.pkey, Curve: skey.curveSkey[:], Ed: skey.edSkey[:]},
+		Lifetime: int64(lifetime / time.Second),
+		Confirm:  confirm,
+	})
+	return err
+}
+
+func (c *AgentClient) Remove(id []byte) error {
+	_, err := c.call(agentRequest{Op: "remove", ID: id})
+	return err
+}
+
+func (c *AgentClient) RemoveAll() error {
+	_, err := c.call(agentRequest{Op: "removeall"})
+	return err
+}
+
+func (c *AgentClient) List() ([]*Pkey, error) {
+	resp, err := c.call(agentRequest{Op: "list"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+func (c *AgentClient) Lock(passphrase []byte) error {
+	_, err := c.call(agentRequest{Op: "lock", Passphrase: passphrase})
+	return err
+}
+
+func (c *AgentClient) Unlock(passphrase []byte) error {
+	_, err := c.call(agentRequest{Op: "unlock", Passphrase: passphrase})
+	return err
+}
+
+// Sign signs message for ContextFile.
+func (c *AgentClient) Sign(id []byte, message []byte) ([]byte, error) {
+	return c.SignWithContext(id, message, SigAlgEd25519ctx, ContextFile)
+}
+
+func (c *AgentClient) SignWithContext(id []byte, message []byte, alg string, context string) ([]byte, error) {
+	resp, err := c.call(agentRequest{Op: "sign", ID: id, Data: message, Alg: alg, Context: context})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (c *AgentClient) OpenSealed(id []byte, sealed []byte) ([]byte, error) {
+	resp, err := c.call(agentRequest{Op: "decrypt", ID: id, Data: sealed})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// agentSign and agentOpen are used for locked keys.
+func agentSign(skey *Skey, message []byte, alg string, context string) ([]byte, error) {
+	client, err := AgentFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return client.SignWithContext(skey.ID, message, alg, context)
+}
+
+func agentOpen(skey *Skey, sealed []byte) ([]byte, error) {
+	client, err := AgentFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return client.OpenSealed(skey.ID, sealed)
+}
@@ -0,0 +1,454 @@
+package cryptostack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// AttachedAlg names the attached signature format in its header line.
+const AttachedAlg = "cryptostack-attached"
+
+const (
+	attachedChunkSize = 64 * 1024
+	maxAttachedChunk  = 1024 * 1024
+	maxSignatureSize  = 64 * 1024
+
+	clearSignBegin = "-----BEGIN CRYPTOSTACK SIGNED MESSAGE-----"
+	signatureBegin = "-----BEGIN CRYPTOSTACK SIGNATURE-----"
+	signatureEnd   = "-----END CRYPTOSTACK SIGNATURE-----"
+)
+
+type attachedHeader struct {
+	Alg string `json:"alg"`
+}
+
+// attachedWriter writes the payload as length prefixed chunks, an empty
+// chunk ends it and is followed by the signature.
+type attachedWriter struct {
+	w    *bufio.Writer
+	skey *Skey
+	sig  *Signature
+	hash hash.Hash
+	buf  []byte
+}
+
+// NewAttachedWriter returns a writer that wraps everything written to it and
+// its signature by skey into one file. sig gives the signature mode, context
+// and metadata, nil makes an Ed25519ctx signature for ContextFile. The
+// signature is written on Close.
+func NewAttachedWriter(w io.Writer, skey *Skey, sig *Signature) (io.WriteCloser, error) {
+	if sig == nil {
+		sig = NewSignature(skey.GetPkey())
+	}
+	header, err := json.Marshal(attachedHeader{Alg: AttachedAlg})
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(w)
+	_, err = bw.Write(append(header, '\n'))
+	if err != nil {
+		return nil, err
+	}
+	return &attachedWriter{w: bw, skey: skey, sig: sig, hash: sig.newHash()}, nil
+}
+
+func (aw *attachedWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		k := attachedChunkSize - len(aw.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		aw.buf = append(aw.buf, p[:k]...)
+		p = p[k:]
+		if len(aw.buf) == attachedChunkSize {
+			err := aw.flush()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (aw *attachedWriter) flush() error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(aw.buf)))
+	_, err := aw.w.Write(size[:])
+	if err != nil {
+		return err
+	}
+	_, err = aw.w.Write(aw.buf)
+	if err != nil {
+		return err
+	}
+	aw.hash.Write(aw.buf)
+	aw.buf = aw.buf[:0]
+	return nil
+}
+
+func (aw *attachedWriter) Close() error {
+	if len(aw.buf) > 0 {
+		err := aw.flush()
+		if err != nil {
+			return err
+		}
+	}
+	err := aw.flush()
+	if err != nil {
+		return err
+	}
+	err = aw.sig.signHash(aw.skey, aw.hash.Sum(nil))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(aw.sig)
+	if err != nil {
+		return err
+	}
+	_, err = aw.w.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return aw.w.Flush()
+}
+
+// clearSignWriter dash-escapes the text line by line, a line starting with
+// a dash gets a "- " prefix so it can't be taken for a marker.
+type clearSignWriter struct {
+	w    *bufio.Writer
+	skey *Skey
+	sig  *Signature
+	hash hash.Hash
+	line []byte
+}
+
+// NewClearSignWriter returns a writer that signs the text written to it by
+// skey and writes it readable, followed by the armored signature on Close.
+// sig is used like in NewAttachedWriter, nil makes an Ed25519ctx signature
+// for ContextFile. Line endings are signed as "\n".
+func NewClearSignWriter(w io.Writer, skey *Skey, sig *Signature) (io.WriteCloser, error) {
+	if sig == nil {
+		sig = NewSignature(skey.GetPkey())
+	}
+	bw := bufio.NewWriter(w)
+	_, err := bw.WriteString(clearSignBegin + "\n")
+	if err != nil {
+		return nil, err
+	}
+	return &clearSignWriter{w: bw, skey: skey, sig: sig, hash: sig.newHash()}, nil
+}
+
+func (cw *clearSignWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			cw.line = append(cw.line, p...)
+			break
+		}
+		cw.line = append(cw.line, p[:i]...)
+		p = p[i+1:]
+		err := cw.writeLine(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (cw *clearSignWriter) writeLine(newline bool) error {
+	line := bytes.TrimSuffix(cw.line, []byte("\r"))
+	cw.hash.Write(line)
+	if newline {
+		cw.hash.Write([]byte("\n"))
+	}
+	if len(line) > 0 && line[0] == '-' {
+		cw.w.WriteString("- ")
+	}
+	cw.w.Write(line)
+	_, err := cw.w.WriteString("\n")
+	cw.line = cw.line[:0]
+	return err
+}
+
+func (cw *clearSignWriter) Close() error {
+	// The newline before the signature marker is not part of the text, so
+	// text without a final newline comes back the same.
+	if len(cw.line) > 0 {
+		err := cw.writeLine(false)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := cw.w.WriteString("\n")
+		if err != nil {
+			return err
+		}
+	}
+	err := cw.sig.signHash(cw.skey, cw.hash.Sum(nil))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(cw.sig)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	cw.w.WriteString(signatureBegin + "\n")
+	for len(encoded) > 64 {
+		cw.w.WriteString(encoded[:64] + "\n")
+		encoded = encoded[64:]
+	}
+	cw.w.WriteString(encoded + "\n")
+	cw.w.WriteString(signatureEnd + "\n")
+	return cw.w.Flush()
+}
+
+// SignedPayload is a payload read together with its signature by
+// ReadAttached or ReadClearSigned. The payload is spooled to a temporary
+// file and can be read with WriteTo only after a successful Verify.
+type SignedPayload struct {
+	Signature *Signature
+	file      *os.File
+	verified  bool
+}
+
+func newSignedPayload() (*SignedPayload, error) {
+	file, err := os.CreateTemp("", "cryptostack-payload")
+	if err != nil {
+		return nil, err
+	}
+	// The file is only reachable through the descriptor from now on.
+	os.Remove(file.Name())
+	return &SignedPayload{file: file}, nil
+}
+
+// ReadAttached reads a file written by NewAttachedWriter. The signature is
+// not checked yet, call Verify or VerifyWith.
+func ReadAttached(r io.Reader) (*SignedPayload, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var header attachedHeader
+	err = json.Unmarshal(line, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != AttachedAlg {
+		return nil, errors.New("Unknown attached signature format")
+	}
+
+	sp, err := newSignedPayload()
+	if err != nil {
+		return nil, err
+	}
+	var chunks bytes.Buffer
+	for {
+		var size [4]byte
+		_, err = io.ReadFull(br, size[:])
+		if err == nil {
+			n := binary.BigEndian.Uint32(size[:])
+			if n == 0 {
+				break
+			}
+			if n > maxAttachedChunk {
+				err = errors.New("Attached chunk too large")
+			} else {
+				chunks.Reset()
+				_, err = io.CopyN(&chunks, br, int64(n))
+				if err == nil {
+					_, err = sp.file.Write(chunks.Bytes())
+				}
+			}
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			sp.Close()
+			return nil, err
+		}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(br, maxSignatureSize))
+	if err == nil {
+		err = sp.setSignature(data)
+	}
+	if err != nil {
+		sp.Close()
+		return nil, err
+	}
+	return sp, nil
+}
+
+// ReadClearSigned reads a text written by NewClearSignWriter. Anything
+// before the first marker line is skipped. The signature is not checked
+// yet, call Verify or VerifyWith.
+func ReadClearSigned(r io.Reader) (*SignedPayload, error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := readTextLine(br)
+		if err == io.EOF {
+			return nil, errors.New("No signed message")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == clearSignBegin {
+			break
+		}
+	}
+
+	sp, err := newSignedPayload()
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(sp.file)
+	first := true
+	for {
+		var line string
+		line, err = readTextLine(br)
+		if err == io.EOF {
+			err = errors.New("No signature")
+		}
+		if err != nil {
+			break
+		}
+		if line == signatureBegin {
+			break
+		}
+		if strings.HasPrefix(line, "- ") {
+			line = line[2:]
+		} else if strings.HasPrefix(line, "-") {
+			err = errors.New("Bad dash escaping")
+			break
+		}
+		if !first {
+			w.WriteString("\n")
+		}
+		first = false
+		_, err = w.WriteString(line)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		sp.Close()
+		return nil, err
+	}
+
+	var encoded strings.Builder
+	for {
+		var line string
+		line, err = readTextLine(br)
+		if err == io.EOF {
+			err = errors.New("No signature end")
+		}
+		if err != nil || line == signatureEnd {
+			break
+		}
+		if encoded.Len()+len(line) > maxSignatureSize {
+			err = errors.New("Signature too large")
+			break
+		}
+		encoded.WriteString(strings.TrimSpace(line))
+	}
+	if err == nil {
+		var data []byte
+		data, err = base64.StdEncoding.DecodeString(encoded.String())
+		if err == nil {
+			err = sp.setSignature(data)
+		}
+	}
+	if err != nil {
+		sp.Close()
+		return nil, err
+	}
+	return sp, nil
+}
+
+// readTextLine reads a line without its "\n" or "\r\n" ending.
+func readTextLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func (sp *SignedPayload) setSignature(data []byte) error {
+	sig := &Signature{}
+	err := json.Unmarshal(data, sig)
+	if err != nil {
+		return err
+	}
+	if sig.Pkey == nil {
+		return errors.New("Signature has no public key")
+	}
+	sp.Signature = sig
+	return nil
+}
+
+// Verify checks the signature with pkey, which replaces the public key
+// carried in the signature.
+func (sp *SignedPayload) Verify(pkey *Pkey) (*SignatureMeta, error) {
+	if pkey == nil {
+		return nil, errors.New("No public key")
+	}
+	return sp.VerifyWith(func(sig *Signature, r io.Reader) (*SignatureMeta, error) {
+		sig.Pkey = pkey
+		return sig.Verify(r)
+	})
+}
+
+// VerifyWith checks the signature with verify, e.g. Keyring.Verify or
+// Revocations.Verify, given the signature and the spooled payload.
+func (sp *SignedPayload) VerifyWith(verify func(sig *Signature, r io.Reader) (*SignatureMeta, error)) (*SignatureMeta, error) {
+	sp.verified = false
+	_, err := sp.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := verify(sp.Signature, sp.file)
+	if err != nil {
+		return nil, err
+	}
+	sp.verified = true
+	return meta, nil
+}
+
+// WriteTo writes the payload to w, it fails unless the signature has been
+// verified.
+func (sp *SignedPayload) WriteTo(w io.Writer) (int64, error) {
+	if !sp.verified {
+		return 0, errors.New("Signature is not verified")
+	}
+	_, err := sp.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, sp.file)
+}
+
+// Close removes the spooled payload.
+func (sp *SignedPayload) Close() error {
+	sp.verified = false
+	return sp.file.Close()
+}
@@ -0,0 +1,288 @@
+package cryptostack
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"io"
+
+	"filippo.io/edwards25519"
+)
+
+// batchMin is the size below which a failed batch is checked signature by
+// signature instead of being split further.
+const batchMin = 4
+
+// BatchVerifier checks many Ed25519 signatures at once, which is several
+// times faster than calling Pkey.Verify for each of them. Ed25519ctx and
+// Ed25519ph signatures, and so Signatures, go into the same batch.
+//
+// The batch equation is the cofactored one, so a signature with crafted
+// small order components that Pkey.Verify rejects may pass in a batch.
+// Only the holder of the secret key can make such a signature.
+type BatchVerifier struct {
+	entries []*batchEntry
+	n       int
+}
+
+type batchEntry struct {
+	index   int
+	pkey    *Pkey
+	message []byte
+	sig     []byte
+	alg     string
+	context string
+	// err is set for entries failed before verification, meta for the
+	// metadata signature of a Signature.
+	err  error
+	meta bool
+
+	// A, R, S and k are set for entries that can go into the batch
+	// equation [8]([S]B - R - [k]A) = 0.
+	A, R *edwards25519.Point
+	S, k *edwards25519.Scalar
+}
+
+// NewBatchVerifier returns an empty batch.
+func NewBatchVerifier() *BatchVerifier {
+	return &BatchVerifier{}
+}
+
+// Add queues the signature sig of message by pkey, like Pkey.Verify.
+func (bv *BatchVerifier) Add(pkey *Pkey, message []byte, sig []byte) {
+	bv.AddWithContext(pkey, message, sig, SigAlgEd25519, "")
+}
+
+// AddWithContext queues a signature like Pkey.VerifyWithContext.
+func (bv *BatchVerifier) AddWithContext(pkey *Pkey, message []byte, sig []byte, alg string, context string) {
+	bv.entries = append(bv.entries, &batchEntry{index: bv.n, pkey: pkey, message: message, sig: sig, alg: alg, context: context})
+	bv.n++
+}
+
+// AddSignature queues sig of the content read from r, like Signature.Verify.
+// The signature of its metadata goes into the batch too.
+func (bv *BatchVerifier) AddSignature(sig *Signature, r io.Reader) {
+	e := &batchEntry{index: bv.n, pkey: sig.Pkey, message: sig.Hash, sig: sig.Sig, alg: sig.Alg, context: ContextFile}
+	bv.n++
+	bv.entries = append(bv.entries, e)
+	if sig.Alg != SigAlgEd25519ctx && sig.Alg != SigAlgEd25519ph {
+		e.err = errors.New("Unsupported signature algorithm")
+		return
+	}
+	if sig.Context != ContextFile {
+		e.err = ErrSignatureContext
+		return
+	}
+	if sig.Pkey == nil {
+		e.err = errors.New("Signature has no public key")
+		return
+	}
+	hash, err := sig.computeHash(r)
+	if err != nil {
+		e.err = err
+		return
+	}
+	if !bytes.Equal(sig.Hash, hash) {
+		e.err = errors.New("Bad checksum")
+		return
+	}
+	if sig.Meta == nil {
+		if sig.MetaSig != nil {
+			e.err = errors.New("Signature metadata is missing")
+		}
+		return
+	}
+	bv.entries = append(bv.entries, &batchEntry{index: e.index, pkey: sig.Pkey, message: sig.metaData(), sig: sig.MetaSig,
+		alg: SigAlgEd25519ctx, context: ContextMeta, meta: true})
+}
+
+// Len returns the number of queued signatures.
+func (bv *BatchVerifier) Len() int {
+	return bv.n
+}
+
+// Verify checks all queued signatures and returns nil if all of them are
+// valid. Otherwise it returns an error for each signature in the order
+// they were added, nil for the valid ones. The bad signatures of a failed
+// batch are found by splitting it in halves.
+func (bv *BatchVerifier) Verify() []error {
+	errs := make([]error, bv.n)
+	// A Signature has two entries, the first error is kept.
+	report := func(e *batchEntry, err error) {
+		if errs[e.index] == nil {
+			errs[e.index] = err
+		}
+	}
+	var batch []*batchEntry
+	// Each key is checked and decoded once, signatures usually come from a
+	// few keys.
+	keys := map[*Pkey]*batchKey{}
+	for _, e := range bv.entries {
+		if e.err != nil {
+			report(e, e.err)
+			continue
+		}
+		if e.pkey == nil {
+			report(e, errors.New("No public key"))
+			continue
+		}
+		key := keys[e.pkey]
+		if key == nil {
+			key = newBatchKey(e.pkey)
+			keys[e.pkey] = key
+		}
+		if key.err != nil {
+			report(e, key.err)
+			continue
+		}
+		// Entries the batch can't take are checked on their own, that gives
+		// them the error of Pkey.VerifyWithContext.
+		if key.A == nil || !e.parse(key.A) {
+			report(e, e.verify())
+			continue
+		}
+		batch = append(batch, e)
+	}
+	verifyBatch(batch, report)
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+type batchKey struct {
+	err error
+	A   *edwards25519.Point
+}
+
+func newBatchKey(pkey *Pkey) *batchKey {
+	err := pkey.CheckUsage(UsageSign)
+	if err != nil {
+		return &batchKey{err: err}
+	}
+	A, err := decodePoint(pkey.GetEdKey()[:])
+	if err != nil {
+		return &batchKey{}
+	}
+	return &batchKey{A: A}
+}
+
+func (e *batchEntry) parse(A *edwards25519.Point) bool {
+	if len(e.sig) != 64 {
+		return false
+	}
+	var err error
+	e.A = A
+	e.R, err = decodePoint(e.sig[:32])
+	if err != nil {
+		return false
+	}
+	e.S, err = edwards25519.NewScalar().SetCanonicalBytes(e.sig[32:])
+	if err != nil {
+		return false
+	}
+	h := sha512.New()
+	// dom2 of RFC 8032 separates the Ed25519ctx and Ed25519ph variants.
+	switch e.alg {
+	case SigAlgEd25519:
+	case SigAlgEd25519ctx, SigAlgEd25519ph:
+		if len(e.context) > 255 || e.alg == SigAlgEd25519ctx && e.context == "" ||
+			e.alg == SigAlgEd25519ph && len(e.message) != sha512.Size {
+			return false
+		}
+		h.Write([]byte("SigEd25519 no Ed25519 collisions"))
+		if e.alg == SigAlgEd25519ph {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{byte(len(e.context))})
+		h.Write([]byte(e.context))
+	default:
+		return false
+	}
+	h.Write(e.sig[:32])
+	h.Write(e.pkey.GetEdKey()[:])
+	h.Write(e.message)
+	e.k, err = edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	return err == nil
+}
+
+// verify checks the entry on its own.
+func (e *batchEntry) verify() error {
+	if e.meta {
+		if e.pkey.verifyContext(e.message, e.sig, e.context) != nil {
+			return errors.New("Bad signature metadata")
+		}
+		return nil
+	}
+	return e.pkey.VerifyWithContext(e.message, e.sig, e.alg, e.context)
+}
+
+// decodePoint accepts only canonical encodings, like the single signature
+// check which compares the encoding of R.
+func decodePoint(b []byte) (*edwards25519.Point, error) {
+	p, err := new(edwards25519.Point).SetBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p.Bytes(), b) {
+		return nil, errors.New("Non-canonical point")
+	}
+	return p, nil
+}
+
+// verifyBatch reports the result of each entry to report, a failed batch
+// is split in halves until the parts are small.
+func verifyBatch(batch []*batchEntry, report func(*batchEntry, error)) {
+	if len(batch) == 0 {
+		return
+	}
+	if batchEquation(batch) {
+		for _, e := range batch {
+			report(e, nil)
+		}
+		return
+	}
+	if len(batch) <= batchMin {
+		for _, e := range batch {
+			report(e, e.verify())
+		}
+		return
+	}
+	verifyBatch(batch[:len(batch)/2], report)
+	verifyBatch(batch[len(batch)/2:], report)
+}
+
+// batchEquation checks [8]([-sum z_i S_i]B + sum [z_i]R_i + sum [z_i k_i]A_i) = 0
+// with random 128 bit z_i, a bad signature passes with probability 2^-128.
+func batchEquation(batch []*batchEntry) bool {
+	random := make([]byte, 16*len(batch))
+	_, err := rand.Read(random)
+	if err != nil {
+		return false
+	}
+	scalars := make([]*edwards25519.Scalar, 0, 1+2*len(batch))
+	points := make([]*edwards25519.Point, 0, 1+2*len(batch))
+	bCoeff := edwards25519.NewScalar()
+	scalars = append(scalars, bCoeff)
+	points = append(points, edwards25519.NewGeneratorPoint())
+	var zBytes [32]byte
+	for i, e := range batch {
+		copy(zBytes[:16], random[16*i:])
+		z, err := edwards25519.NewScalar().SetCanonicalBytes(zBytes[:])
+		if err != nil {
+			return false
+		}
+		bCoeff.MultiplyAdd(z, e.S, bCoeff)
+		scalars = append(scalars, z, edwards25519.NewScalar().Multiply(z, e.k))
+		points = append(points, e.R, e.A)
+	}
+	bCoeff.Negate(bCoeff)
+	check := new(edwards25519.Point).VarTimeMultiScalarMult(scalars, points)
+	check.MultByCofactor(check)
+	return check.Equal(edwards25519.NewIdentityPoint()) == 1
+}
@@ -0,0 +1,157 @@
+package cryptostack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	UsageSign    = "sign"
+	UsageEncrypt = "encrypt"
+	UsageCertify = "certify"
+
+	maxChainLength = 8
+)
+
+// Certificate is a binding of Pkey, its validity period and allowed
+// usages signed by Issuer.
+type Certificate struct {
+	Alg       string   `json:"alg"`
+	Pkey      *Pkey    `json:"pkey"`
+	Issuer    *Pkey    `json:"issuer"`
+	NotBefore int64    `json:"notbefore"`
+	NotAfter  int64    `json:"notafter"`
+	Usages    []string `json:"usages"`
+	Sig       []byte   `json:"sig"`
+}
+
+func (skey *Skey) Certify(pkey *Pkey, notBefore, notAfter time.Time, usages []string) (*Certificate, error) {
+	if skey.edSkey == nil || skey.pkey == nil {
+		return nil, errors.New("Key is locked")
+	}
+	cert := &Certificate{
+		Alg:       SigAlgEd25519ctx,
+		Pkey:      pkey,
+		Issuer:    skey.GetPkey(),
+		NotBefore: notBefore.Unix(),
+		NotAfter:  notAfter.Unix(),
+		Usages:    usages,
+	}
+	var err error
+	cert.Sig, err = skey.SignWithContext(cert.signedData(), SigAlgEd25519ctx, ContextCertificate)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Verify checks the issuer's signature only, see CertPool for validity
+// and usages.
+func (cert *Certificate) Verify() error {
+	if cert.Alg != SigAlgEd25519ctx {
+		return errors.New("Unsupported certificate algorithm")
+	}
+	if cert.Pkey == nil || cert.Issuer == nil {
+		return errors.New("Certificate has no key")
+	}
+	return cert.Issuer.verifyContext(cert.signedData(), cert.Sig, ContextCertificate)
+}
+
+func (cert *Certificate) ValidAt(t time.Time) bool {
+	return t.Unix() >= cert.NotBefore && t.Unix() <= cert.NotAfter
+}
+
+func (cert *Certificate) Allows(usage string) bool {
+	for _, u := range cert.Usages {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+func (cert *Certificate) signedData() []byte {
+	var data bytes.Buffer
+	fields := [][]byte{[]byte("cryptostack certificate"), []byte(cert.Alg)}
+	fields = append(fields, pkeyFields(cert.Pkey)...)
+	fields = append(fields, pkeyFields(cert.Issuer)...)
+	for _, u := range cert.Usages {
+		fields = append(fields, []byte(u))
+	}
+	binary.Write(&data, binary.BigEndian, uint32(len(cert.Usages)))
+	writeFields(&data, fields)
+	binary.Write(&data, binary.BigEndian, cert.NotBefore)
+	binary.Write(&data, binary.BigEndian, cert.NotAfter)
+	return data.Bytes()
+}
+
+// CertPool holds trusted root keys and certificates, and finds chains
+// from a key to one of the roots.
+type CertPool struct {
+	mu    sync.RWMutex
+	roots []*Pkey
+	certs map[string][]*Certificate
+}
+
+func NewCertPool() *CertPool {
+	return &CertPool{certs: map[string][]*Certificate{}}
+}
+
+func (cp *CertPool) AddRoot(pkey *Pkey) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.roots = append(cp.roots, pkey)
+}
+
+func (cp *CertPool) AddCert(cert *Certificate) error {
+	err := cert.Verify()
+	if err != nil {
+		return err
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	key := string(cert.Pkey.Ed.Pkey)
+	cp.certs[key] = append(cp.certs[key], cert)
+	return nil
+}
+
+// Verify returns the chain of certificates from pkey to a trusted root,
+// leaf first. The leaf certificate must allow usage, the others must allow
+// UsageCertify, and all of them must be valid at t, as well as the metadata
+// of the keys. A root key itself has an empty chain.
+func (cp *CertPool) Verify(pkey *Pkey, usage string, t time.Time) ([]*Certificate, error) {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	chain, ok := cp.walk(pkey, usage, t, nil)
+	if !ok {
+		return nil, ErrUntrustedKey
+	}
+	return chain, nil
+}
+
+func (cp *CertPool) walk(pkey *Pkey, usage string, t time.Time, chain []*Certificate) ([]*Certificate, bool) {
+	if pkey.checkMeta(usage, t) != nil {
+		return nil, false
+	}
+	for _, root := range cp.roots {
+		if samePkey(pkey, root) {
+			return chain, true
+		}
+	}
+	if len(chain) == maxChainLength {
+		return nil, false
+	}
+	for _, cert := range cp.certs[string(pkey.Ed.Pkey)] {
+		if !samePkey(cert.Pkey, pkey) || !cert.ValidAt(t) || !cert.Allows(usage) {
+			continue
+		}
+		found, ok := cp.walk(cert.Issuer, UsageCertify, t, append(chain, cert))
+		if ok {
+			return found, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/ArtemKulyabin/cryptostack"
+	"github.com/bgentry/speakeasy"
+	"github.com/codegangsta/cli"
+)
+
+var agentCommand = cli.Command{
+	Name:  "agent",
+	Usage: "run or control the agent keeping unlocked keys",
+	Subcommands: []cli.Command{
+		{
+			Name:   "start",
+			Usage:  "run the agent and print the environment to use it",
+			Action: agentStart,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "socket",
+					Usage: "socket path (default in a new temporary directory)",
+				},
+				cli.StringFlag{
+					Name:  "confirm-command",
+					Usage: "command approving use of keys added with --confirm by its exit status, gets JSIGN_KEY_ID and JSIGN_OP",
+				},
+			},
+		},
+		{
+			Name:   "add",
+			Usage:  "unlock secret key and add it to the agent",
+			Action: agentAdd,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "lifetime",
+					Usage: "remove the key after this time, e.g. 8h",
+				},
+				cli.BoolFlag{
+					Name:  "confirm",
+					Usage: "ask the confirm command before every use of the key",
+				},
+			},
+		},
+		{
+			Name:   "list",
+			Usage:  "list keys of the agent",
+			Action: agentList,
+		},
+		{
+			Name:   "remove",
+			Usage:  "remove key from the agent, all keys without argument",
+			Action: agentRemove,
+		},
+		{
+			Name:   "lock",
+			Usage:  "lock the agent with a passphrase",
+			Action: agentLock,
+		},
+		{
+			Name:   "unlock",
+			Usage:  "unlock the agent",
+			Action: agentUnlock,
+		},
+	},
+}
+
+func agentStart(c *cli.Context) {
+	sock := c.String("socket")
+	if sock == "" {
+		dir, err := ioutil.TempDir("", "jsign-agent")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer os.RemoveAll(dir)
+		sock = filepath.Join(dir, "agent.sock")
+	}
+	sl, err := listenPrivate(sock)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	l := peerListener{sl}
+
+	agent := cryptostack.NewAgent()
+	if command := c.String("confirm-command"); command != "" {
+		agent.Confirm = func(pkey *cryptostack.Pkey, op string) bool {
+			cmd := exec.Command("/bin/sh", "-c", command)
+			cmd.Env = append(os.Environ(), "JSIGN_KEY_ID="+hex.EncodeToString(pkey.ID), "JSIGN_OP="+op)
+			cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+			return cmd.Run() == nil
+		}
+	}
+
+	// The socket is removed on interrupt, like ssh-agent does.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		l.Close()
+	}()
+
+	fmt.Printf("%s=%s; export %s;\n", cryptostack.AgentSockEnv, sock, cryptostack.AgentSockEnv)
+	agent.Serve(l)
+}
+
+// peerListener drops connections of other users, in case the socket is
+// reachable by them.
+type peerListener struct {
+	net.Listener
+}
+
+func (l peerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if samePeer(conn) {
+			return conn, nil
+		}
+		log.Println("Rejected agent client of another user")
+		conn.Close()
+	}
+}
+
+func agentAdd(c *cli.Context) {
+	skey := loadSkey(c.Args().First())
+	err := dialAgent().Add(skey, c.Duration("lifetime"), c.Bool("confirm"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func agentList(c *cli.Context) {
+	keys, err := dialAgent().List()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, pkey := range keys {
+		comment := ""
+		if pkey.Meta != nil {
+			comment = pkey.Meta.Comment
+		}
+		fmt.Printf("%x  %s\n", pkey.ID, comment)
+	}
+}
+
+func agentRemove(c *cli.Context) {
+	agent := dialAgent()
+	var err error
+	if c.Args().First() == "" {
+		err = agent.RemoveAll()
+	} else {
+		err = agent.Remove(readPkey(c.Args().First()).ID)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func agentLock(c *cli.Context) {
+	passphrase, err := speakeasy.Ask("Please enter a passphrase to lock the agent: ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = dialAgent().Lock([]byte(passphrase))
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func agentUnlock(c *cli.Context) {
+	passphrase, err := speakeasy.Ask("Please enter the agent passphrase: ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = dialAgent().Unlock([]byte(passphrase))
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func dialAgent() *cryptostack.AgentClient {
+	agent, err := cryptostack.AgentFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return agent
+}
+
+// agentHasKey tells if the agent named by the environment holds skey, so it
+// can be used without asking for its password.
+func agentHasKey(skey *cryptostack.Skey) bool {
+	agent, err := cryptostack.AgentFromEnv()
+	if err != nil {
+		return false
+	}
+	defer agent.Close()
+	keys, err := agent.List()
+	if err != nil {
+		return false
+	}
+	for _, pkey := range keys {
+		if bytes.Equal(pkey.ID, skey.ID) && bytes.Equal(pkey.Ed.Pkey, skey.Ed.Pkey) {
+			return true
+		}
+	}
+	return false
+}
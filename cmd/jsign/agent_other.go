@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "net"
+
+func listenPrivate(sock string) (net.Listener, error) {
+	return net.Listen("unix", sock)
+}
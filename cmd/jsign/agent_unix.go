@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivate creates the socket with mode 0600 from the start, a chmod
+// after Listen would give other users a moment to connect.
+func listenPrivate(sock string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", sock)
+}
@@ -1,62 +1,398 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/ArtemKulyabin/cryptostack"
 	"github.com/bgentry/speakeasy"
 	"github.com/codegangsta/cli"
 )
 
+// keyring is set by the --keyring flag, key names are then looked up in it
+// by label or ID before trying files.
+var keyring *cryptostack.Keyring
+
+var formatFlag = cli.StringFlag{
+	Name:  "format",
+	Value: "jsig",
+	Usage: "signature or key format: jsig, attached, clearsign, minisign, signify, ssh or pem (keys only)",
+}
+
+var contextFlag = cli.StringFlag{
+	Name:  "context",
+	Usage: "signature context, verify requires it (default the file signing context)",
+}
+
+var namespaceFlag = cli.StringFlag{
+	Name:  "namespace",
+	Value: "file",
+	Usage: "namespace of ssh signatures",
+}
+
+var keyFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name: "no-password",
+	},
+	cli.StringFlag{
+		Name:  "kdf",
+		Value: cryptostack.KdfPbkdf2Blake2b,
+		Usage: "password kdf: pbkdf2-blake2b, argon2id or scrypt",
+	},
+	cli.BoolFlag{
+		Name:  "ed25519",
+		Usage: "single ed25519 key, the curve25519 key is derived from it",
+	},
+	cli.StringFlag{
+		Name:  "comment",
+		Usage: "comment stored in the key metadata",
+	},
+	cli.IntFlag{
+		Name:  "expires",
+		Usage: "key lifetime in days",
+	},
+	cli.StringSliceFlag{
+		Name:  "usage",
+		Usage: "allowed key usage: sign, encrypt or certify (default any)",
+	},
+}
+
 func main() {
+	cryptostack.LockMemory = true
+
 	app := cli.NewApp()
 	app.Name = "jsign"
 	app.Usage = ""
 	app.Version = "0.0.1"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "keyring",
+			Usage:  "keyring file or directory",
+			EnvVar: "JSIGN_KEYRING",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if path := c.GlobalString("keyring"); path != "" {
+			var err error
+			keyring, err = cryptostack.OpenKeyring(path)
+			return err
+		}
+		return nil
+	}
 
 	app.Commands = []cli.Command{
 		{
 			Name:   "generate",
 			Usage:  "generate keys",
 			Action: generate,
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.BoolFlag{
-					Name: "no-password",
+					Name:  "mnemonic",
+					Usage: "derive keys from a seed and print its recovery phrase",
 				},
-			},
+			}, keyFlags...),
+		},
+		{
+			Name:   "restore",
+			Usage:  "restore keys from a recovery phrase read from stdin",
+			Action: restore,
+			Flags:  keyFlags,
 		},
 		{
 			Name:   "sign",
 			Usage:  "sign file",
 			Action: sign,
+			Flags: []cli.Flag{
+				formatFlag,
+				namespaceFlag,
+				cli.StringFlag{
+					Name:  "comment",
+					Usage: "trusted comment, signed with the signing time and file name",
+				},
+				cli.StringFlag{
+					Name:  "purpose",
+					Usage: "signed purpose of the signature, e.g. release",
+				},
+				cli.StringFlag{
+					Name:  "untrusted-comment",
+					Usage: "comment stored in the signature without being signed",
+				},
+				cli.StringFlag{
+					Name:  "mode",
+					Value: cryptostack.SigAlgEd25519ctx,
+					Usage: "signature algorithm: ed25519ctx or ed25519ph",
+				},
+				contextFlag,
+			},
 		},
 		{
 			Name:   "verify",
 			Usage:  "verify file",
 			Action: verify,
+			Flags: []cli.Flag{
+				formatFlag,
+				namespaceFlag,
+				cli.BoolFlag{
+					Name:  "legacy",
+					Usage: "accept pure ed25519 signatures of older versions",
+				},
+				cli.StringSliceFlag{
+					Name:  "revocations",
+					Usage: "revocation or rotation statement to check the key against",
+				},
+				cli.StringFlag{
+					Name:  "purpose",
+					Usage: "require this signed purpose",
+				},
+				contextFlag,
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "write the payload of an attached or clear-signed file here instead of stdout",
+				},
+			},
+		},
+		{
+			Name:   "revoke",
+			Usage:  "make revocation statement for a key",
+			Action: revoke,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "reason",
+					Usage: "reason of revocation, e.g. compromised",
+				},
+			},
+		},
+		{
+			Name:   "rotate",
+			Usage:  "make statement that a key is replaced by a new one",
+			Action: rotate,
+		},
+		{
+			Name:   "fingerprint",
+			Usage:  "show fingerprint of public key",
+			Action: fingerprint,
+		},
+		{
+			Name:   "export",
+			Usage:  "export keys as minisign, signify, ssh or pem key files",
+			Action: export,
+			Flags:  []cli.Flag{formatFlag},
+		},
+		{
+			Name:   "import",
+			Usage:  "import a minisign, signify, ssh or pem secret key",
+			Action: importKey,
+			Flags: append([]cli.Flag{
+				formatFlag,
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "secret key file to import, the ed25519 one for pem",
+				},
+				cli.StringFlag{
+					Name:  "from-x25519",
+					Usage: "x25519 secret key file to import with pem (default derived from ed25519)",
+				},
+			}, keyFlags...),
+		},
+		agentCommand,
+		multisigCommand,
+		{
+			Name:  "keyring",
+			Usage: "manage keys of the keyring given with --keyring",
+			Subcommands: []cli.Command{
+				{
+					Name:   "add",
+					Usage:  "add public key, or secret key with --secret",
+					Action: keyringAdd,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "label",
+							Usage: "name to refer to the key",
+						},
+						cli.StringFlag{
+							Name:  "trust",
+							Value: "unknown",
+							Usage: "trust level: unknown, never, marginal, full or ultimate",
+						},
+						cli.BoolFlag{
+							Name:  "secret",
+							Usage: "the key file is a secret key",
+						},
+					},
+				},
+				{
+					Name:   "list",
+					Usage:  "list keys",
+					Action: keyringList,
+				},
+				{
+					Name:   "remove",
+					Usage:  "remove key",
+					Action: keyringRemove,
+				},
+				{
+					Name:   "trust",
+					Usage:  "set trust level of key",
+					Action: keyringTrust,
+				},
+				{
+					Name:   "label",
+					Usage:  "set label of key",
+					Action: keyringLabel,
+				},
+			},
+		},
+		{
+			Name:   "split",
+			Usage:  "split secret key into shares written to prefix-N.txt, or stdout without prefix",
+			Action: split,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "threshold",
+					Value: 2,
+					Usage: "number of shares needed to combine the key",
+				},
+				cli.IntFlag{
+					Name:  "shares",
+					Value: 3,
+					Usage: "number of shares",
+				},
+			},
+		},
+		{
+			Name:   "combine",
+			Usage:  "combine secret key from shares read from stdin",
+			Action: combine,
+			Flags:  keyFlags,
+		},
+		{
+			Name:   "passwd",
+			Usage:  "change password and kdf of secret key",
+			Action: passwd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "kdf",
+					Usage: "new password kdf: pbkdf2-blake2b, argon2id or scrypt (default the kdf of the key)",
+				},
+				cli.DurationFlag{
+					Name:  "calibrate",
+					Usage: "tune kdf rounds to take this long to unlock the key on this machine, e.g. 1s",
+				},
+				cli.BoolFlag{
+					Name:  "no-password",
+					Usage: "remove password protection",
+				},
+			},
+		},
+		{
+			Name:   "migrate",
+			Usage:  "convert secret key, and public key if given, to the current format",
+			Action: migrate,
 		},
 	}
 	app.Run(os.Args)
 }
 
 func generate(c *cli.Context) {
-	skey, err := cryptostack.GenerateKey()
+	kdf, err := cryptostack.NewKdf(c.String("kdf"))
 	if err != nil {
 		log.Fatalln(err)
 	}
-	if !c.Bool("no-password") {
-		password, err := speakeasy.Ask("Please enter a password: ")
+	var skey *cryptostack.Skey
+	if c.Bool("mnemonic") {
+		seed, err := cryptostack.GenerateSeed()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		mnemonic, err := cryptostack.SeedToMnemonic(seed)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Fprintln(os.Stderr, "Recovery phrase:", mnemonic)
+		skey = generateFromSeed(c, seed, kdf)
+	} else if c.Bool("ed25519") {
+		skey, err = cryptostack.GenerateEdKey(kdf)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		skey, err = cryptostack.GenerateKeyWithKdf(kdf)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	saveKeys(c, skey)
+}
+
+func restore(c *cli.Context) {
+	kdf, err := cryptostack.NewKdf(c.String("kdf"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	mnemonic, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatalln(err)
+	}
+	seed, err := cryptostack.MnemonicToSeed(mnemonic)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	saveKeys(c, generateFromSeed(c, seed, kdf))
+}
+
+func generateFromSeed(c *cli.Context, seed []byte, kdf *cryptostack.Kdf) *cryptostack.Skey {
+	generate := cryptostack.GenerateKeyFromSeed
+	if c.Bool("ed25519") {
+		generate = cryptostack.GenerateEdKeyFromSeed
+	}
+	skey, err := generate(seed, kdf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return skey
+}
+
+func saveKeys(c *cli.Context, skey *cryptostack.Skey) {
+	// Metadata restored by combine is kept unless given again.
+	meta := *skey.Meta
+	if c.IsSet("comment") {
+		meta.Comment = c.String("comment")
+	}
+	if c.IsSet("usage") {
+		meta.Usages = c.StringSlice("usage")
+	}
+	if days := c.Int("expires"); days > 0 {
+		meta.Expires = time.Unix(meta.Created, 0).AddDate(0, 0, days).Unix()
+	}
+	err := skey.SetMeta(meta)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var bc []byte
+	if c.Bool("no-password") {
+		bc, err = marshalUnencrypted(skey)
+	} else {
+		var password string
+		password, err = speakeasy.Ask("Please enter a password: ")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = skey.Encrypt([]byte(password))
 		if err != nil {
 			log.Fatalln(err)
 		}
-		skey.Encrypt([]byte(password))
+		bc, err = json.MarshalIndent(skey, "", " ")
 	}
-	bc, err := json.MarshalIndent(skey, "", " ")
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -85,59 +421,184 @@ func generate(c *cli.Context) {
 }
 
 func sign(c *cli.Context) {
-	skeyFile := c.Args().First()
-	skeyBuf, err := ioutil.ReadFile(skeyFile + ".jkey")
-	if err != nil {
-		log.Fatalln(err)
+	var skey *cryptostack.Skey
+	// A locked key held by the agent signs jsig, attached and clear-signed
+	// signatures through it.
+	switch c.String("format") {
+	case "jsig", "attached", "clearsign":
+		skey = readSkey(c.Args().First())
+		if !agentHasKey(skey) {
+			skey = loadSkey(c.Args().First())
+		}
+	default:
+		skey = loadSkey(c.Args().First())
 	}
-	skey := cryptostack.Skey{}
-	err = json.Unmarshal(skeyBuf, &skey)
+
+	file := c.Args().Get(1)
+
+	f, err := os.Open(file)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	defer f.Close()
 
-	if !c.Bool("no-password") {
-		password, err := speakeasy.Ask("Please enter a password: ")
+	switch c.String("format") {
+	case "minisign":
+		comment := fmt.Sprintf("timestamp:%d\tfile:%s", time.Now().Unix(), filepath.Base(file))
+		if c.String("comment") != "" {
+			comment = c.String("comment")
+		}
+		sig, err := cryptostack.SignMinisign(skey, f, comment, true)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = ioutil.WriteFile(file+".minisig", sig.Marshal(), 0644)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	case "signify":
+		message, err := ioutil.ReadAll(f)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sig, err := cryptostack.SignSignify(skey, message, "verify with "+c.Args().First()+".pub")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = ioutil.WriteFile(file+".sig", sig, 0644)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	case "ssh":
+		sig, err := cryptostack.SignSSH(skey, f, c.String("namespace"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sigBuf, err := sig.Marshal()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = ioutil.WriteFile(file+".sig", sigBuf, 0644)
 		if err != nil {
 			log.Fatalln(err)
 		}
-		skey.Decrypt([]byte(password))
+		return
 	}
 
-	sig := cryptostack.NewSignature(skey.GetPkey())
+	sig := cryptostack.NewContextSignature(skey.GetPkey(), c.String("mode"), c.String("context"))
+	sig.Meta = &cryptostack.SignatureMeta{
+		Comment: c.String("comment"),
+		File:    filepath.Base(file),
+		Purpose: c.String("purpose"),
+	}
+	sig.UntrustedComment = c.String("untrusted-comment")
 
-	file := c.Args().Get(1)
+	switch c.String("format") {
+	case "attached", "clearsign":
+		signAttached(c, skey, sig, f, file)
+		return
+	}
 
-	f, err := os.Open(file)
+	err = sig.Sign(skey, f)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	err = sig.Sign(&skey, f)
+	sigBuf, err := json.MarshalIndent(sig, "", " ")
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	sigBuf, err := json.MarshalIndent(sig, "", " ")
 	err = ioutil.WriteFile(strings.Join([]string{file, "jsig"}, "."), sigBuf, 0644)
 	if err != nil {
 		log.Fatalln(err)
 	}
 }
 
-func verify(c *cli.Context) {
-	pkeyFile := c.Args().First()
-	pkeyBuf, err := ioutil.ReadFile(pkeyFile + ".jkey")
+// signAttached writes file with its signature to file.jsigned, or as
+// clear-signed text to file.asc.
+func signAttached(c *cli.Context, skey *cryptostack.Skey, sig *cryptostack.Signature, f io.Reader, file string) {
+	newWriter, outFile := cryptostack.NewAttachedWriter, file+".jsigned"
+	if c.String("format") == "clearsign" {
+		newWriter, outFile = cryptostack.NewClearSignWriter, file+".asc"
+	}
+	out, err := os.Create(outFile)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	pkey := cryptostack.Pkey{}
-	err = json.Unmarshal(pkeyBuf, &pkey)
+	w, err := newWriter(out, skey, sig)
+	if err == nil {
+		_, err = io.Copy(w, f)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	}
 	if err != nil {
+		out.Close()
+		os.Remove(outFile)
 		log.Fatalln(err)
 	}
+}
 
-	file := c.Args().Get(1)
+func verify(c *cli.Context) {
+	switch c.String("format") {
+	case "minisign", "signify", "ssh":
+		verifyForeign(c)
+		return
+	}
+
+	// With a keyring the key may be omitted, it is then found by the key
+	// ID of the signature.
+	pkeyName, file := c.Args().First(), c.Args().Get(1)
+	if keyring != nil && len(c.Args()) == 1 {
+		pkeyName, file = "", pkeyName
+	}
+
+	revocations := readRevocations(c)
+	verifySig := func(sig *cryptostack.Signature, r io.Reader) (*cryptostack.SignatureMeta, error) {
+		var pkey *cryptostack.Pkey
+		var err error
+		if pkeyName != "" {
+			pkey = readPkey(pkeyName)
+		} else if sig.Pkey != nil {
+			pkey, err = keyring.Lookup(sig.Pkey.ID)
+			if err != nil {
+				log.Fatalf("%s: %x\n", err, sig.Pkey.ID)
+			}
+		} else {
+			log.Fatalln("Signature has no key")
+		}
+		sig.Pkey = pkey
+		context := c.String("context")
+		if context == "" {
+			context = cryptostack.ContextFile
+		}
+		var meta *cryptostack.SignatureMeta
+		if c.Bool("legacy") && sig.Alg == cryptostack.SigAlgEd25519 {
+			err = revocations.Check(pkey)
+			if err == nil {
+				err = sig.VerifyLegacy(r)
+			}
+		} else {
+			meta, err = revocations.VerifyContext(sig, r, context)
+		}
+		if err == cryptostack.ErrKeyRetired {
+			if successor := revocations.Successor(pkey); successor != nil {
+				log.Fatalf("%s, use key %x instead\n", err, successor.ID)
+			}
+		}
+		return meta, err
+	}
+
+	switch c.String("format") {
+	case "attached", "clearsign":
+		verifyAttached(c, file, verifySig)
+		return
+	}
 
 	sigFile := strings.Join([]string{file, "jsig"}, ".")
 	sigBuf, err := ioutil.ReadFile(sigFile)
@@ -155,9 +616,678 @@ func verify(c *cli.Context) {
 		log.Fatalln(err)
 	}
 
-	err = sig.Verify(f)
+	meta, err := verifySig(&sig, f)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	checkPurpose(c, meta)
 	fmt.Println("Ok")
+	if meta != nil {
+		printSignatureMeta(os.Stdout, meta)
+	}
+}
+
+// verifyAttached checks an attached or clear-signed file and only then
+// writes its payload to --output or stdout, the result goes to stderr.
+func verifyAttached(c *cli.Context, file string, verifySig func(*cryptostack.Signature, io.Reader) (*cryptostack.SignatureMeta, error)) {
+	read := cryptostack.ReadAttached
+	if c.String("format") == "clearsign" {
+		read = cryptostack.ReadClearSigned
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	payload, err := read(f)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer payload.Close()
+	meta, err := payload.VerifyWith(verifySig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	checkPurpose(c, meta)
+
+	out := os.Stdout
+	if outFile := c.String("output"); outFile != "" {
+		out, err = os.Create(outFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	_, err = payload.WriteTo(out)
+	if err == nil && out != os.Stdout {
+		err = out.Close()
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Fprintln(os.Stderr, "Ok")
+	if meta != nil {
+		printSignatureMeta(os.Stderr, meta)
+	}
+}
+
+func readRevocations(c *cli.Context) *cryptostack.Revocations {
+	revocations := cryptostack.NewRevocations()
+	for _, stFile := range c.StringSlice("revocations") {
+		stBuf, err := ioutil.ReadFile(stFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		st := &cryptostack.KeyStatement{}
+		err = json.Unmarshal(stBuf, st)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = revocations.Add(st)
+		if err != nil {
+			log.Fatalln(stFile+":", err)
+		}
+	}
+	return revocations
+}
+
+func checkPurpose(c *cli.Context, meta *cryptostack.SignatureMeta) {
+	if purpose := c.String("purpose"); purpose != "" && (meta == nil || meta.Purpose != purpose) {
+		log.Fatalln("Signature is not for purpose", purpose)
+	}
+}
+
+func printSignatureMeta(w io.Writer, meta *cryptostack.SignatureMeta) {
+	if meta.Timestamp != 0 {
+		fmt.Fprintln(w, "Signed:", time.Unix(meta.Timestamp, 0).Format(time.RFC3339))
+	}
+	if meta.File != "" {
+		fmt.Fprintln(w, "File:", meta.File)
+	}
+	if meta.Purpose != "" {
+		fmt.Fprintln(w, "Purpose:", meta.Purpose)
+	}
+	if meta.Comment != "" {
+		fmt.Fprintln(w, "Trusted comment:", meta.Comment)
+	}
+}
+
+// verifyForeign checks a minisign, signify or ssh signature, the public
+// key file is given by its full name.
+func verifyForeign(c *cli.Context) {
+	pkeyBuf, err := ioutil.ReadFile(c.Args().First())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	file := c.Args().Get(1)
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	switch c.String("format") {
+	case "ssh":
+		pkey, _, err := cryptostack.ParseAuthorizedKey(pkeyBuf)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sigBuf, err := ioutil.ReadFile(file + ".sig")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sig, err := cryptostack.ParseSSHSignature(sigBuf)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = sig.Verify(pkey, f, c.String("namespace"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println("Ok")
+		return
+	case "minisign":
+		pkey, err := cryptostack.ParseMinisignPkey(pkeyBuf)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sigBuf, err := ioutil.ReadFile(file + ".minisig")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sig, err := cryptostack.ParseMinisignSignature(sigBuf)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = sig.Verify(pkey, f)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println("Ok")
+		fmt.Println("Trusted comment:", sig.TrustedComment)
+		return
+	}
+
+	pkey, err := cryptostack.ParseSignifyPkey(pkeyBuf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	sigBuf, err := ioutil.ReadFile(file + ".sig")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	message, err := ioutil.ReadAll(f)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = cryptostack.VerifySignify(pkey, message, sigBuf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("Ok")
+}
+
+func revoke(c *cli.Context) {
+	skey := loadSkey(c.Args().First())
+	st, err := cryptostack.NewRevocation(skey, c.String("reason"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	writeJSON(c.Args().Get(1), st)
+}
+
+func rotate(c *cli.Context) {
+	skey := loadSkey(c.Args().First())
+	newPkey := readPkey(c.Args().Get(1))
+	st, err := cryptostack.NewRotation(skey, newPkey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	writeJSON(c.Args().Get(2), st)
+}
+
+func fingerprint(c *cli.Context) {
+	pkey := readPkey(c.Args().First())
+	fp := pkey.Fingerprint()
+	fmt.Println("Hex:   ", fp.Hex())
+	fmt.Println("Base32:", fp.Base32())
+	fmt.Println("Words: ", fp.Words())
+	fmt.Println(fp.Randomart("JSIGN"))
+}
+
+// export writes name.pub and name.key (minisign), name.sec (signify) or
+// name (ssh), the secret key is protected with the password of the jkey.
+// The pem format has a file per key half, see exportPEM.
+func export(c *cli.Context) {
+	skeyFile := c.Args().First()
+	skey := readSkey(skeyFile)
+	password, err := speakeasy.Ask("Please enter a password: ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = skey.Decrypt([]byte(password))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	name := c.Args().Get(1)
+	if name == "" {
+		name = skeyFile
+	}
+
+	var pkeyBuf, skeyBuf []byte
+	ext := ".key"
+	switch c.String("format") {
+	case "pem":
+		exportPEM(skey, name, password)
+		return
+	case "minisign":
+		pkeyBuf, err = skey.GetPkey().MarshalMinisign()
+		if err == nil {
+			skeyBuf, err = skey.MarshalMinisign([]byte(password))
+		}
+	case "signify":
+		ext = ".sec"
+		pkeyBuf, err = skey.GetPkey().MarshalSignify()
+		if err == nil {
+			skeyBuf, err = skey.MarshalSignify([]byte(password))
+		}
+	case "ssh":
+		ext = ""
+		comment := ""
+		if skey.Meta != nil {
+			comment = skey.Meta.Comment
+		}
+		pkeyBuf, err = skey.GetPkey().MarshalAuthorizedKey(comment)
+		if err == nil {
+			skeyBuf, err = skey.MarshalOpenSSH([]byte(password), comment)
+		}
+	default:
+		log.Fatalln("Unknown format")
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = ioutil.WriteFile(name+".pub", pkeyBuf, 0644)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = ioutil.WriteFile(name+ext, skeyBuf, 0400)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// exportPEM writes PKCS#8 secret keys to name-ed25519.pem and
+// name-x25519.pem, and their SubjectPublicKeyInfo to name-ed25519.pub.pem
+// and name-x25519.pub.pem.
+func exportPEM(skey *cryptostack.Skey, name string, password string) {
+	edPkey, curvePkey, err := skey.GetPkey().MarshalPKIX()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	edSkey, curveSkey, err := skey.MarshalPKCS8([]byte(password))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	files := []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{name + "-ed25519.pub.pem", edPkey, 0644},
+		{name + "-x25519.pub.pem", curvePkey, 0644},
+		{name + "-ed25519.pem", edSkey, 0400},
+		{name + "-x25519.pem", curveSkey, 0400},
+	}
+	for _, f := range files {
+		err = ioutil.WriteFile(f.name, f.data, f.perm)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func importKey(c *cli.Context) {
+	buf, err := ioutil.ReadFile(c.String("from"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	password, err := speakeasy.Ask("Please enter the password of the imported key: ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var skey *cryptostack.Skey
+	switch c.String("format") {
+	case "minisign":
+		skey, err = cryptostack.ParseMinisignSkey(buf, []byte(password))
+	case "signify":
+		skey, err = cryptostack.ParseSignifySkey(buf, []byte(password))
+	case "ssh":
+		skey, err = cryptostack.ParseOpenSSHSkey(buf, []byte(password))
+	case "pem":
+		var curveBuf []byte
+		if curveFile := c.String("from-x25519"); curveFile != "" {
+			curveBuf, err = ioutil.ReadFile(curveFile)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+		skey, err = cryptostack.ParsePKCS8(buf, curveBuf, []byte(password))
+	default:
+		log.Fatalln("Unknown format")
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	kdf, err := cryptostack.NewKdf(c.String("kdf"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	skey.Kdf = *kdf
+	saveKeys(c, skey)
+}
+
+func migrate(c *cli.Context) {
+	skeyFile := c.Args().First()
+	password, err := speakeasy.Ask("Please enter a password: ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	skey := readSkeyFile(skeyFile)
+	err = skey.Decrypt([]byte(password))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// Metadata signed by older versions is signed again for its context.
+	if skey.Meta != nil {
+		err = skey.SetMeta(*skey.Meta)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	err = skey.Encrypt([]byte(password))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	writeKey(skeyFile, skey)
+	if pkeyFile := c.Args().Get(1); pkeyFile != "" {
+		writeKey(pkeyFile, skey.GetPkey())
+	}
+}
+
+func split(c *cli.Context) {
+	skey := loadSkey(c.Args().First())
+	shares, err := skey.Split(c.Int("threshold"), c.Int("shares"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	skey.Wipe()
+	prefix := c.Args().Get(1)
+	for i, share := range shares {
+		if prefix == "" {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Print(share.Text())
+			continue
+		}
+		err = ioutil.WriteFile(fmt.Sprintf("%s-%d.txt", prefix, share.Index), []byte(share.Text()), 0400)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// combine reads shares separated by their header lines or blank lines.
+func combine(c *cli.Context) {
+	kdf, err := cryptostack.NewKdf(c.String("kdf"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var shares []*cryptostack.Share
+	var block []string
+	add := func() {
+		if len(block) == 0 {
+			return
+		}
+		share, err := cryptostack.ParseShare(strings.Join(block, "\n"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		shares = append(shares, share)
+		block = nil
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "cryptostack share") {
+			add()
+		}
+		if line != "" {
+			block = append(block, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	add()
+
+	skey, err := cryptostack.CombineShares(shares)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	skey.Kdf = *kdf
+	saveKeys(c, skey)
+}
+
+func passwd(c *cli.Context) {
+	skeyFile := c.Args().First()
+	skey := readSkeyFile(skeyFile)
+	oldPassword, err := speakeasy.Ask("Please enter the old password: ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var kdf *cryptostack.Kdf
+	alg := c.String("kdf")
+	if alg == "" {
+		alg = skey.Kdf.Alg
+	}
+	if c.Duration("calibrate") > 0 {
+		kdf, err = cryptostack.CalibrateKdf(alg, c.Duration("calibrate"))
+	} else if c.String("kdf") != "" {
+		kdf, err = cryptostack.NewKdf(alg)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var newPassword []byte
+	if !c.Bool("no-password") {
+		password, err := speakeasy.Ask("Please enter a new password: ")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		repeated, err := speakeasy.Ask("Please repeat the new password: ")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if password != repeated {
+			log.Fatalln("Passwords don't match")
+		}
+		newPassword = []byte(password)
+	}
+
+	err = skey.ChangePassword([]byte(oldPassword), newPassword, kdf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if newPassword == nil {
+		bc, err := skey.MarshalUnencrypted()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		writeKey(skeyFile, json.RawMessage(bc))
+	} else {
+		writeKey(skeyFile, skey)
+	}
+	skey.Wipe()
+}
+
+func keyringAdd(c *cli.Context) {
+	trust, err := cryptostack.ParseTrust(c.String("trust"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	entry := cryptostack.KeyringEntry{Label: c.String("label"), Trust: trust}
+	if c.Bool("secret") {
+		entry.Skey = readSkeyFile(c.Args().First())
+	} else {
+		entry.Pkey = readPkeyFile(c.Args().First())
+	}
+	err = openKeyring().Add(entry)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func keyringList(c *cli.Context) {
+	for _, entry := range openKeyring().List() {
+		secret := ""
+		if entry.Skey != nil {
+			secret = "secret"
+		}
+		fmt.Printf("%x  %-8s  %-6s  %s\n", entry.Pkey.ID, entry.Trust, secret, entry.Label)
+	}
+}
+
+func keyringRemove(c *cli.Context) {
+	err := openKeyring().Remove(findEntry(c.Args().First()).Pkey.ID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func keyringTrust(c *cli.Context) {
+	trust, err := cryptostack.ParseTrust(c.Args().Get(1))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = openKeyring().SetTrust(findEntry(c.Args().First()).Pkey.ID, trust)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func keyringLabel(c *cli.Context) {
+	err := openKeyring().SetLabel(findEntry(c.Args().First()).Pkey.ID, c.Args().Get(1))
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func openKeyring() *cryptostack.Keyring {
+	if keyring == nil {
+		log.Fatalln("No keyring, use --keyring or JSIGN_KEYRING")
+	}
+	return keyring
+}
+
+// findEntry returns the keyring entry labeled name or with a hex ID
+// starting with name, which must be unique.
+func findEntry(name string) *cryptostack.KeyringEntry {
+	entries := openKeyring().Find(name)
+	if len(entries) != 1 {
+		log.Fatalf("%d keys match %q\n", len(entries), name)
+	}
+	return entries[0]
+}
+
+func readPkey(name string) *cryptostack.Pkey {
+	if entry := namedEntry(name); entry != nil {
+		return entry.Pkey
+	}
+	return readPkeyFile(name)
+}
+
+func readSkey(name string) *cryptostack.Skey {
+	if entry := namedEntry(name); entry != nil {
+		if entry.Skey == nil {
+			log.Fatalf("%s: keyring key has no secret key\n", name)
+		}
+		return entry.Skey
+	}
+	return readSkeyFile(name)
+}
+
+// namedEntry returns the only keyring entry matching name, or nil to read
+// the key file name if none does. The key must be trusted as for
+// Keyring.Lookup, a key matched by name is never silently replaced by a
+// file.
+func namedEntry(name string) *cryptostack.KeyringEntry {
+	if keyring == nil {
+		return nil
+	}
+	entries := keyring.Find(name)
+	if len(entries) == 0 {
+		return nil
+	}
+	if len(entries) > 1 {
+		ids := make([]string, len(entries))
+		for i, entry := range entries {
+			ids[i] = fmt.Sprintf("%x", entry.Pkey.ID)
+		}
+		log.Fatalf("%s: ambiguous key name, matches keyring keys %s\n", name, strings.Join(ids, ", "))
+	}
+	if entries[0].Trust == cryptostack.TrustNever {
+		log.Fatalf("%s: keyring key is trusted never\n", name)
+	}
+	_, err := keyring.Lookup(entries[0].Pkey.ID)
+	if err != nil {
+		log.Fatalf("%s: %s\n", name, err)
+	}
+	return entries[0]
+}
+
+func readPkeyFile(pkeyFile string) *cryptostack.Pkey {
+	pkeyBuf, err := ioutil.ReadFile(pkeyFile + ".jkey")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	pkey := &cryptostack.Pkey{}
+	err = json.Unmarshal(pkeyBuf, pkey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return pkey
+}
+
+func readSkeyFile(skeyFile string) *cryptostack.Skey {
+	skeyBuf, err := ioutil.ReadFile(skeyFile + ".jkey")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	skey := &cryptostack.Skey{}
+	err = json.Unmarshal(skeyBuf, skey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return skey
+}
+
+func loadSkey(skeyFile string) *cryptostack.Skey {
+	skey := readSkey(skeyFile)
+	password, err := speakeasy.Ask("Please enter a password: ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = skey.Decrypt([]byte(password))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return skey
+}
+
+func marshalUnencrypted(skey *cryptostack.Skey) ([]byte, error) {
+	bc, err := skey.MarshalUnencrypted()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = json.Indent(&buf, bc, "", " ")
+	return buf.Bytes(), err
+}
+
+// writeKey replaces a key file through a rename, so an interrupted write
+// never leaves a truncated key behind.
+func writeKey(keyFile string, key interface{}) {
+	bc, err := json.MarshalIndent(key, "", " ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	tmp := keyFile + ".jkey.tmp"
+	err = ioutil.WriteFile(tmp, bc, 0400)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = os.Rename(tmp, keyFile+".jkey")
+	if err != nil {
+		os.Remove(tmp)
+		log.Fatalln(err)
+	}
+}
+
+// writeJSON writes v to file, or to stdout if file is empty.
+func writeJSON(file string, v interface{}) {
+	bc, err := json.MarshalIndent(v, "", " ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if file == "" {
+		fmt.Println(string(bc))
+		return
+	}
+	err = ioutil.WriteFile(file, bc, 0644)
+	if err != nil {
+		log.Fatalln(err)
+	}
 }
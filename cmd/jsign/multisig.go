@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ArtemKulyabin/cryptostack"
+	"github.com/codegangsta/cli"
+)
+
+var multisigCommand = cli.Command{
+	Name:  "multisig",
+	Usage: "sign a file by several keys into file.msig and verify m of n of them",
+	Subcommands: []cli.Command{
+		{
+			Name:   "sign",
+			Usage:  "add signature of secret key to file.msig, creating it",
+			Action: multisigSign,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "comment",
+					Usage: "trusted comment, signed with the signing time and file name",
+				},
+				cli.StringFlag{
+					Name:  "purpose",
+					Usage: "signed purpose of the signature, e.g. release",
+				},
+			},
+		},
+		{
+			Name:   "add",
+			Usage:  "add detached jsig signatures of file to file.msig",
+			Action: multisigAdd,
+		},
+		{
+			Name:   "verify",
+			Usage:  "verify file.msig has signatures of enough of the given or trusted keyring keys",
+			Action: multisigVerify,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "threshold",
+					Value: 1,
+					Usage: "number of distinct trusted keys that must have signed",
+				},
+				cli.StringSliceFlag{
+					Name:  "revocations",
+					Usage: "revocation or rotation statement to check the keys against",
+				},
+			},
+		},
+	},
+}
+
+// multisigSign signs file with the first argument, the key file or the
+// agent, and adds the signature to file.msig.
+func multisigSign(c *cli.Context) {
+	skey := readSkey(c.Args().First())
+	if !agentHasKey(skey) {
+		skey = loadSkey(c.Args().First())
+	}
+	file := c.Args().Get(1)
+	ms := readMultiSignature(file)
+	meta := &cryptostack.SignatureMeta{
+		Comment: c.String("comment"),
+		File:    filepath.Base(file),
+		Purpose: c.String("purpose"),
+	}
+	err := ms.Sign(skey, meta)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	writeJSON(file+".msig", ms)
+}
+
+func multisigAdd(c *cli.Context) {
+	file := c.Args().First()
+	ms := readMultiSignature(file)
+	for _, sigFile := range c.Args().Tail() {
+		sigBuf, err := ioutil.ReadFile(sigFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sig := &cryptostack.Signature{}
+		err = json.Unmarshal(sigBuf, sig)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = ms.Add(sig)
+		if err != nil {
+			log.Fatalln(sigFile+":", err)
+		}
+	}
+	writeJSON(file+".msig", ms)
+}
+
+// multisigVerify trusts the public keys given after the file, and with
+// --keyring the trusted keys of the keyring.
+func multisigVerify(c *cli.Context) {
+	file := c.Args().First()
+	msBuf, err := ioutil.ReadFile(file + ".msig")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ms := &cryptostack.MultiSignature{}
+	err = json.Unmarshal(msBuf, ms)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	policy := &cryptostack.MultiSigPolicy{
+		Threshold:   c.Int("threshold"),
+		Keyring:     keyring,
+		Revocations: readRevocations(c),
+	}
+	for _, name := range c.Args().Tail() {
+		policy.Keys = append(policy.Keys, readPkey(name))
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	signers, err := ms.Verify(f, policy)
+	for _, pkey := range signers {
+		fmt.Printf("Signed by %x\n", pkey.ID)
+	}
+	if err == cryptostack.ErrNotEnoughSignatures {
+		log.Fatalf("%s: %d of %d\n", err, len(signers), policy.Threshold)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("Ok")
+}
+
+// readMultiSignature reads file.msig, or starts it, after checking that
+// file has the hash signed by it.
+func readMultiSignature(file string) *cryptostack.MultiSignature {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	ms, err := cryptostack.NewMultiSignature(f)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	msBuf, err := ioutil.ReadFile(file + ".msig")
+	if os.IsNotExist(err) {
+		return ms
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	signed := &cryptostack.MultiSignature{}
+	err = json.Unmarshal(msBuf, signed)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !bytes.Equal(signed.Hash, ms.Hash) {
+		log.Fatalln(file + ".msig is for other content")
+	}
+	return signed
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// samePeer can't tell the client user here, the mode of the socket alone
+// keeps other users out.
+func samePeer(conn net.Conn) bool {
+	return true
+}
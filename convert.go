@@ -0,0 +1,35 @@
+package cryptostack
+
+import (
+	"crypto/sha512"
+	"errors"
+
+	"filippo.io/edwards25519"
+)
+
+// EdPkeyToCurve maps an Ed25519 public key to the Curve25519 public key of
+// the same secret, like libsodium's crypto_sign_ed25519_pk_to_curve25519.
+func EdPkeyToCurve(edPkey *[32]byte) (*[32]byte, error) {
+	p, err := new(edwards25519.Point).SetBytes(edPkey[:])
+	if err != nil {
+		return nil, errors.New("Bad ed25519 public key")
+	}
+	if new(edwards25519.Point).MultByCofactor(p).Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, errors.New("Bad ed25519 public key")
+	}
+	curvePkey := &[32]byte{}
+	copy(curvePkey[:], p.BytesMontgomery())
+	return curvePkey, nil
+}
+
+// EdSkeyToCurve is the secret key counterpart of EdPkeyToCurve, like
+// libsodium's crypto_sign_ed25519_sk_to_curve25519.
+func EdSkeyToCurve(edSkey *[64]byte) *[32]byte {
+	h := sha512.Sum512(edSkey[:32])
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	curveSkey := &[32]byte{}
+	copy(curveSkey[:], h[:32])
+	return curveSkey
+}
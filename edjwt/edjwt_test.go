@@ -1,6 +1,11 @@
 package edjwt
 
 import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/ArtemKulyabin/cryptostack"
@@ -12,8 +17,70 @@ func TestJwt(t *testing.T) {
 		t.Fatal(err)
 	}
 	token := New()
-	_, err = token.SignedString(skey)
+	token.Claims["sub"] = "user"
+	tokenString, err := token.SignedString(skey)
 	if err != nil {
 		t.Fatal(err)
 	}
+	parsed, err := Parse(tokenString, skey.GetPkey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Valid || parsed.Claims["sub"] != "user" {
+		t.Fatal("Bad token")
+	}
+	// Tokens are RFC 8037 EdDSA JWTs named by the thumbprint of the JWK.
+	jwk, _, err := skey.GetPkey().JWK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["alg"] != "EdDSA" || parsed.Header["kid"] != jwk.Kid {
+		t.Fatal("Bad token header")
+	}
+	parts := strings.Split(tokenString, ".")
+	sig, err := DecodeSegment(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(skey.GetPkey().GetEdKey()[:], []byte(parts[0]+"."+parts[1]), sig) {
+		t.Fatal("Token is not an EdDSA JWT")
+	}
+	token.Header["alg"] = "ED25519"
+	tokenString2, err := token.SignedString(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Parse(tokenString2, skey.GetPkey()); err == nil {
+		t.Fatal("Token with unknown alg accepted")
+	}
+
+	dir, err := ioutil.TempDir("", "edjwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kr, err := cryptostack.OpenKeyring(filepath.Join(dir, "keyring.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kr.Add(cryptostack.KeyringEntry{Pkey: skey.GetPkey(), Trust: cryptostack.TrustFull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseWithKeyring(tokenString, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := cryptostack.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenString, err = New().SignedString(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseWithKeyring(tokenString, kr); err == nil {
+		t.Fatal("Unknown key accepted")
+	}
 }
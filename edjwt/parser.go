@@ -48,7 +48,7 @@ func (p *Parser) Parse(tokenString string, pkey *cryptostack.Pkey /*keyFunc Keyf
 
 	// Lookup signature method
 	if method, ok := token.Header["alg"].(string); ok {
-		if method != "ED25519" {
+		if method != "EdDSA" {
 			return token, &ValidationError{err: "signing method (alg) is unavailable.", Errors: ValidationErrorUnverifiable}
 		}
 	} else {
@@ -100,7 +100,11 @@ func (p *Parser) Parse(tokenString string, pkey *cryptostack.Pkey /*keyFunc Keyf
 
 	// Perform validation
 	token.Signature = parts[2]
-	if err = pkey.Verify([]byte(strings.Join(parts[0:2], ".")), []byte(token.Signature)); err != nil {
+	sig, err := DecodeSegment(token.Signature)
+	if err == nil {
+		err = pkey.VerifyWithContext([]byte(strings.Join(parts[0:2], ".")), sig, cryptostack.SigAlgEd25519, "")
+	}
+	if err != nil {
 		vErr.err = err.Error()
 		vErr.Errors |= ValidationErrorSignatureInvalid
 	}
@@ -112,3 +116,38 @@ func (p *Parser) Parse(tokenString string, pkey *cryptostack.Pkey /*keyFunc Keyf
 
 	return token, vErr
 }
+
+// ParseWithKeyring is like Parse, the key is looked up in kr by the "kid"
+// header, the RFC 7638 thumbprint of its JWK.
+func (p *Parser) ParseWithKeyring(tokenString string, kr *cryptostack.Keyring) (*Token, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return nil, &ValidationError{err: "token contains an invalid number of segments", Errors: ValidationErrorMalformed}
+	}
+	headerBytes, err := DecodeSegment(parts[0])
+	if err != nil {
+		return nil, &ValidationError{err: err.Error(), Errors: ValidationErrorMalformed}
+	}
+	header := struct {
+		Kid string `json:"kid"`
+	}{}
+	if err = json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, &ValidationError{err: err.Error(), Errors: ValidationErrorMalformed}
+	}
+	if header.Kid == "" {
+		return nil, &ValidationError{err: "key id (kid) is missing.", Errors: ValidationErrorUnverifiable}
+	}
+	var id []byte
+	for _, entry := range kr.List() {
+		jwk, _, err := entry.Pkey.JWK()
+		if err == nil && jwk.Kid == header.Kid {
+			id = entry.Pkey.ID
+			break
+		}
+	}
+	pkey, err := kr.Lookup(id)
+	if err != nil {
+		return nil, &ValidationError{err: err.Error(), Errors: ValidationErrorUnverifiable}
+	}
+	return p.Parse(tokenString, pkey)
+}
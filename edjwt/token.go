@@ -36,19 +36,31 @@ func New() *Token {
 	return &Token{
 		Header: map[string]interface{}{
 			"typ": "JWT",
-			"alg": "ED25519",
+			"alg": "EdDSA",
 		},
 		Claims: make(map[string]interface{}),
 	}
 }
 
-// Get the complete, signed token
+// Get the complete, signed token, an RFC 8037 EdDSA JWT.  The RFC 7638
+// thumbprint of the key, the "kid" of its JWK, goes to the "kid" header
+// unless it is already set.
 func (t *Token) SignedString(skey *cryptostack.Skey) (string, error) {
+	if _, ok := t.Header["kid"]; !ok {
+		jwk, _, err := skey.GetPkey().JWK()
+		if err != nil {
+			return "", err
+		}
+		t.Header["kid"] = jwk.Kid
+	}
 	sstr, err := t.SigningString()
 	if err != nil {
 		return "", err
 	}
-	sig := skey.Sign([]byte(sstr))
+	sig, err := skey.SignWithContext([]byte(sstr), cryptostack.SigAlgEd25519, "")
+	if err != nil {
+		return "", err
+	}
 	return strings.Join([]string{sstr, EncodeSegment(sig)}, "."), nil
 }
 
@@ -84,6 +96,11 @@ func Parse(tokenString string, pkey *cryptostack.Pkey /*keyFunc Keyfunc*/) (*Tok
 	return new(Parser).Parse(tokenString, pkey /*keyFunc*/)
 }
 
+// Parse a token with the key whose JWK thumbprint is its "kid" header in kr.
+func ParseWithKeyring(tokenString string, kr *cryptostack.Keyring) (*Token, error) {
+	return new(Parser).ParseWithKeyring(tokenString, kr)
+}
+
 // Encode JWT specific base64url encoding with padding stripped
 func EncodeSegment(seg []byte) string {
 	return strings.TrimRight(base64.URLEncoding.EncodeToString(seg), "=")
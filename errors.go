@@ -0,0 +1,26 @@
+package cryptostack
+
+import "errors"
+
+var (
+	ErrKeyRevoked = errors.New("Key is revoked")
+	ErrKeyRetired = errors.New("Key is retired")
+	ErrKeyExpired = errors.New("Key is expired")
+	ErrKeyUsage   = errors.New("Key usage is not allowed")
+
+	ErrKeyMetaMissing = errors.New("Key metadata is missing")
+
+	ErrUntrustedKey = errors.New("No valid certificate chain to a trusted root")
+
+	ErrKeyNotFound   = errors.New("Key is not in the keyring")
+	ErrKeyNotTrusted = errors.New("Key is not trusted")
+
+	ErrNoAgent      = errors.New("Key is locked and no agent is available")
+	ErrAgentLocked  = errors.New("Agent is locked")
+	ErrNotConfirmed = errors.New("Key use was not confirmed")
+	ErrAgentPure    = errors.New("Agent does not make pure ed25519 signatures")
+
+	ErrSignatureContext    = errors.New("Signature is made for another context")
+	ErrLegacySignature     = errors.New("Signature is a legacy pure ed25519 signature")
+	ErrNotEnoughSignatures = errors.New("Not enough trusted signatures")
+)
@@ -0,0 +1,127 @@
+package cryptostack
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+
+	"github.com/dchest/blake2b"
+	"github.com/tyler-smith/go-bip39/wordlists"
+)
+
+// Fingerprint is a blake2b-256 hash of the public key material of a Pkey.
+// ID and metadata are not part of it.
+type Fingerprint []byte
+
+func (pkey *Pkey) Fingerprint() Fingerprint {
+	var data bytes.Buffer
+	writeFields(&data, [][]byte{[]byte("cryptostack fingerprint"), []byte(pkey.Alg), pkey.Curve.Pkey, pkey.Ed.Pkey})
+	hash := blake2b.New256()
+	hash.Write(data.Bytes())
+	return hash.Sum([]byte{})
+}
+
+func (fp Fingerprint) String() string {
+	return fp.Hex()
+}
+
+// Hex renders the fingerprint as groups of four hex digits.
+func (fp Fingerprint) Hex() string {
+	s := hex.EncodeToString(fp)
+	var groups []string
+	for len(s) > 4 {
+		groups = append(groups, s[:4])
+		s = s[4:]
+	}
+	return strings.Join(append(groups, s), " ")
+}
+
+func (fp Fingerprint) Base32() string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(fp)
+}
+
+// Words renders the fingerprint with the BIP-39 English word list, 11 bits
+// per word.
+func (fp Fingerprint) Words() string {
+	var words []string
+	var acc, bits uint
+	for _, b := range fp {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 11 {
+			bits -= 11
+			words = append(words, wordlists.English[acc>>bits&0x7ff])
+		}
+	}
+	if bits > 0 {
+		words = append(words, wordlists.English[acc<<(11-bits)&0x7ff])
+	}
+	return strings.Join(words, " ")
+}
+
+// Randomart draws the fingerprint with the drunken bishop algorithm used by
+// OpenSSH's VisualHostKey.
+func (fp Fingerprint) Randomart(title string) string {
+	const (
+		width  = 17
+		height = 9
+		chars  = " .o+=*BOX@%&#/^SE"
+	)
+	top := len(chars) - 1
+	field := [width][height]int{}
+	x, y := width/2, height/2
+	for _, b := range fp {
+		for i := 0; i < 4; i++ {
+			if b&1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if b&2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			if x < 0 {
+				x = 0
+			} else if x > width-1 {
+				x = width - 1
+			}
+			if y < 0 {
+				y = 0
+			} else if y > height-1 {
+				y = height - 1
+			}
+			if field[x][y] < top-2 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[width/2][height/2] = top - 1
+	field[x][y] = top
+
+	var art bytes.Buffer
+	art.WriteString(randomartBorder(title, width) + "\n")
+	for j := 0; j < height; j++ {
+		art.WriteByte('|')
+		for i := 0; i < width; i++ {
+			art.WriteByte(chars[field[i][j]])
+		}
+		art.WriteString("|\n")
+	}
+	art.WriteString(randomartBorder("BLAKE2B", width))
+	return art.String()
+}
+
+func randomartBorder(title string, width int) string {
+	if title != "" {
+		title = "[" + title + "]"
+	}
+	if len(title) > width {
+		title = title[:width]
+	}
+	left := (width - len(title)) / 2
+	return "+" + strings.Repeat("-", left) + title + strings.Repeat("-", width-len(title)-left) + "+"
+}
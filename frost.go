@@ -0,0 +1,664 @@
+package cryptostack
+
+import (
+	"bytes"
+	stded25519 "crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"filippo.io/edwards25519"
+	"github.com/ArtemKulyabin/cryptostack/internal/secmem"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// FrostAlg names key shares of FROST(Ed25519, SHA-512), RFC 9591.
+const FrostAlg = "frost-ed25519-sha512"
+
+// FrostShareVersion is the current key share file format.
+const FrostShareVersion = 1
+
+const (
+	frostContext         = "FROST-ED25519-SHA512-v1"
+	frostMaxParticipants = 255
+)
+
+// FrostGroup is the public part of a FROST key. Commitment is the
+// commitment to the polynomial sharing the group secret, its first element
+// is the group public key, an ordinary Ed25519 key. The public key of each
+// participant is derived from it.
+type FrostGroup struct {
+	ID         []byte   `json:"id"`
+	Threshold  int      `json:"threshold"`
+	Commitment [][]byte `json:"commitment"`
+}
+
+// FrostKeyShare is the secret share of one participant with the group it
+// belongs to. Like a Skey, the share is sealed under a password in Box and
+// everything else is bound to the box as additional data.
+type FrostKeyShare struct {
+	Version int    `json:"version"`
+	Alg     string `json:"alg"`
+	FrostGroup
+	Identifier int    `json:"identifier"`
+	Kdf        Kdf    `json:"kdf"`
+	Skey       []byte `json:"skey,omitempty"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	Box        []byte `json:"box,omitempty"`
+
+	secret    []byte
+	memLocked bool
+}
+
+// FrostCommitment is the public half of the nonces of a participant, sent
+// to the coordinator in round one.
+type FrostCommitment struct {
+	Identifier int    `json:"identifier"`
+	Hiding     []byte `json:"hiding"`
+	Binding    []byte `json:"binding"`
+}
+
+// FrostNonces is the secret half of round one, it must be used for one
+// signature only and never stored.
+type FrostNonces struct {
+	hiding, binding *edwards25519.Scalar
+	commitment      *FrostCommitment
+}
+
+// FrostSignatureShare is the answer of a participant in round two.
+type FrostSignatureShare struct {
+	Identifier int    `json:"identifier"`
+	Share      []byte `json:"share"`
+}
+
+// FrostSplit shares the Ed25519 half of an unlocked skey among n
+// participants as trusted dealer. Any threshold of them make signatures
+// that verify with the public key of skey.
+func FrostSplit(skey *Skey, threshold, n int) ([]*FrostKeyShare, error) {
+	if !skey.unlocked() {
+		return nil, errors.New("Key is locked")
+	}
+	h := sha512.Sum512(skey.edSkey[:32])
+	defer secmem.Wipe(h[:])
+	s, err := edwards25519.NewScalar().SetBytesWithClamping(h[:32])
+	if err != nil {
+		return nil, err
+	}
+	return frostDeal(s, skey.ID, threshold, n)
+}
+
+// FrostGenerate makes a new group key shared among n participants by a
+// trusted dealer, which forgets the group secret afterwards.
+func FrostGenerate(threshold, n int) ([]*FrostKeyShare, error) {
+	s, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	return frostDeal(s, nil, threshold, n)
+}
+
+// frostDeal is trusted_dealer_keygen of RFC 9591 appendix C. A nil id is
+// derived from the group public key.
+func frostDeal(s *edwards25519.Scalar, id []byte, threshold, n int) ([]*FrostKeyShare, error) {
+	if threshold < 2 || n < threshold || n > frostMaxParticipants {
+		return nil, errors.New("Bad FROST threshold or participant count")
+	}
+	coeffs := make([]*edwards25519.Scalar, threshold)
+	defer wipeScalars(coeffs)
+	coeffs[0] = s
+	for i := 1; i < threshold; i++ {
+		var err error
+		coeffs[i], err = randomScalar()
+		if err != nil {
+			return nil, err
+		}
+	}
+	group := &FrostGroup{Threshold: threshold, Commitment: vssCommit(coeffs)}
+	group.ID = id
+	if id == nil {
+		group.ID = importKeyID(group.Commitment[0])
+	}
+
+	shares := make([]*FrostKeyShare, n)
+	for i := 1; i <= n; i++ {
+		y := evalPolynomial(coeffs, frostIdentifier(i))
+		share, err := newFrostKeyShare(group, i, y)
+		if err != nil {
+			return nil, err
+		}
+		shares[i-1] = share
+	}
+	return shares, nil
+}
+
+func newFrostKeyShare(group *FrostGroup, identifier int, secret *edwards25519.Scalar) (*FrostKeyShare, error) {
+	kdf, err := NewKdf(KdfPbkdf2Blake2b)
+	if err != nil {
+		return nil, err
+	}
+	share := &FrostKeyShare{
+		Version:    FrostShareVersion,
+		Alg:        FrostAlg,
+		FrostGroup: *group,
+		Identifier: identifier,
+		Kdf:        *kdf,
+	}
+	share.ID = append([]byte{}, group.ID...)
+	share.setSecret(secret.Bytes())
+	secret.Set(edwards25519.NewScalar())
+	err = share.Check()
+	if err != nil {
+		share.Wipe()
+		return nil, err
+	}
+	return share, nil
+}
+
+// Pkey returns the group public key, which verifies the signatures of the
+// group with Pkey.Verify.
+func (group *FrostGroup) Pkey() (*Pkey, error) {
+	if len(group.Commitment) == 0 {
+		return nil, errors.New("No group commitment")
+	}
+	_, err := decodeElement(group.Commitment[0])
+	if err != nil {
+		return nil, err
+	}
+	edPkey := &[32]byte{}
+	copy(edPkey[:], group.Commitment[0])
+	pkey := NewEdPkey(edPkey)
+	pkey.ID = append([]byte{}, group.ID...)
+	return pkey, nil
+}
+
+// verifyingShare returns the public key of participant i, the commitment
+// evaluated at i.
+func (group *FrostGroup) verifyingShare(i int) (*edwards25519.Point, error) {
+	if i < 1 || i > frostMaxParticipants {
+		return nil, errors.New("Bad FROST identifier")
+	}
+	if group.Threshold < 2 || len(group.Commitment) != group.Threshold {
+		return nil, errors.New("Bad FROST group commitment")
+	}
+	points := make([]*edwards25519.Point, len(group.Commitment))
+	scalars := make([]*edwards25519.Scalar, len(group.Commitment))
+	x := frostIdentifier(i)
+	power := scalarOne()
+	for j, c := range group.Commitment {
+		var err error
+		points[j], err = decodeElement(c)
+		if err != nil {
+			return nil, err
+		}
+		scalars[j] = edwards25519.NewScalar().Set(power)
+		power.Multiply(power, x)
+	}
+	return new(edwards25519.Point).VarTimeMultiScalarMult(scalars, points), nil
+}
+
+// Check verifies that the secret share of an unlocked share matches its
+// public key, vss_verify of RFC 9591.
+func (share *FrostKeyShare) Check() error {
+	if share.Alg != FrostAlg {
+		return errors.New("Unknown FROST key share alg")
+	}
+	s, err := share.scalar()
+	if err != nil {
+		return err
+	}
+	defer s.Set(edwards25519.NewScalar())
+	pub, err := share.verifyingShare(share.Identifier)
+	if err != nil {
+		return err
+	}
+	if new(edwards25519.Point).ScalarBaseMult(s).Equal(pub) != 1 {
+		return errors.New("FROST key share doesn't match the group commitment")
+	}
+	return nil
+}
+
+// Commit is round one of signing: it makes fresh nonces and returns their
+// commitment for the coordinator.
+func (share *FrostKeyShare) Commit() (*FrostNonces, *FrostCommitment, error) {
+	var random [64]byte
+	_, err := rand.Read(random[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return share.commit(random[:32], random[32:])
+}
+
+func (share *FrostKeyShare) commit(hidingRandom, bindingRandom []byte) (*FrostNonces, *FrostCommitment, error) {
+	if share.secret == nil {
+		return nil, nil, errors.New("Key share is locked")
+	}
+	nonces := &FrostNonces{
+		hiding:  frostScalar("nonce", hidingRandom, share.secret),
+		binding: frostScalar("nonce", bindingRandom, share.secret),
+	}
+	nonces.commitment = &FrostCommitment{
+		Identifier: share.Identifier,
+		Hiding:     new(edwards25519.Point).ScalarBaseMult(nonces.hiding).Bytes(),
+		Binding:    new(edwards25519.Point).ScalarBaseMult(nonces.binding).Bytes(),
+	}
+	c := *nonces.commitment
+	return nonces, &c, nil
+}
+
+// Sign is round two: it signs message for the commitments of the signing
+// participants chosen by the coordinator, which must include the one of
+// nonces. The nonces are wiped, they can't be used again.
+func (share *FrostKeyShare) Sign(nonces *FrostNonces, message []byte, commitments []*FrostCommitment) (*FrostSignatureShare, error) {
+	if nonces == nil || nonces.hiding == nil {
+		return nil, errors.New("FROST nonces are used up")
+	}
+	defer nonces.wipe()
+	if share.secret == nil {
+		return nil, errors.New("Key share is locked")
+	}
+	session, err := share.newSession(message, commitments)
+	if err != nil {
+		return nil, err
+	}
+	i := session.index(share.Identifier)
+	if i < 0 || !bytes.Equal(session.list[i].Hiding, nonces.commitment.Hiding) ||
+		!bytes.Equal(session.list[i].Binding, nonces.commitment.Binding) {
+		return nil, errors.New("Own commitment is missing")
+	}
+	s, err := share.scalar()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Set(edwards25519.NewScalar())
+
+	// z = d + e*rho + lambda*s*c
+	z := edwards25519.NewScalar().Multiply(session.lambda(share.Identifier), session.challenge)
+	z.Multiply(z, s)
+	z.MultiplyAdd(nonces.binding, session.rho[i], z)
+	z.Add(z, nonces.hiding)
+	return &FrostSignatureShare{Identifier: share.Identifier, Share: z.Bytes()}, nil
+}
+
+func (nonces *FrostNonces) wipe() {
+	for _, s := range []*edwards25519.Scalar{nonces.hiding, nonces.binding} {
+		if s != nil {
+			s.Set(edwards25519.NewScalar())
+		}
+	}
+	nonces.hiding, nonces.binding = nil, nil
+}
+
+// Aggregate combines the signature shares for commitments into an Ed25519
+// signature of message by the group key. If the signature doesn't verify,
+// the error names the participants with bad shares.
+func (group *FrostGroup) Aggregate(message []byte, commitments []*FrostCommitment, shares []*FrostSignatureShare) ([]byte, error) {
+	session, err := group.newSession(message, commitments)
+	if err != nil {
+		return nil, err
+	}
+	z := make([]*edwards25519.Scalar, len(session.list))
+	for _, share := range shares {
+		i := session.index(share.Identifier)
+		if i < 0 {
+			return nil, fmt.Errorf("Signature share of participant %d without commitment", share.Identifier)
+		}
+		if z[i] != nil {
+			return nil, fmt.Errorf("Duplicate signature share of participant %d", share.Identifier)
+		}
+		z[i], err = edwards25519.NewScalar().SetCanonicalBytes(share.Share)
+		if err != nil {
+			return nil, fmt.Errorf("Bad signature share of participant %d", share.Identifier)
+		}
+	}
+	sum := edwards25519.NewScalar()
+	for i, zi := range z {
+		if zi == nil {
+			return nil, fmt.Errorf("Signature share of participant %d is missing", session.list[i].Identifier)
+		}
+		sum.Add(sum, zi)
+	}
+	sig := append(session.R.Bytes(), sum.Bytes()...)
+	if stded25519.Verify(session.pkey, message, sig) {
+		return sig, nil
+	}
+
+	// Find the culprits with verify_signature_share of RFC 9591.
+	var bad []int
+	for i, c := range session.list {
+		pub, err := group.verifyingShare(c.Identifier)
+		if err != nil {
+			return nil, err
+		}
+		k := edwards25519.NewScalar().Multiply(session.challenge, session.lambda(c.Identifier))
+		r := new(edwards25519.Point).VarTimeMultiScalarMult(
+			[]*edwards25519.Scalar{scalarOne(), session.rho[i], k},
+			[]*edwards25519.Point{session.hiding[i], session.binding[i], pub})
+		if new(edwards25519.Point).ScalarBaseMult(z[i]).Equal(r) != 1 {
+			bad = append(bad, c.Identifier)
+		}
+	}
+	return nil, fmt.Errorf("Bad signature shares of participants %v", bad)
+}
+
+// frostSession holds what round two and the aggregation derive from the
+// message and the sorted commitment list.
+type frostSession struct {
+	pkey            []byte
+	list            []*FrostCommitment
+	hiding, binding []*edwards25519.Point
+	rho             []*edwards25519.Scalar
+	R               *edwards25519.Point
+	challenge       *edwards25519.Scalar
+}
+
+func (group *FrostGroup) newSession(message []byte, commitments []*FrostCommitment) (*frostSession, error) {
+	pkey, err := group.Pkey()
+	if err != nil {
+		return nil, err
+	}
+	if len(commitments) < group.Threshold {
+		return nil, fmt.Errorf("%d signers needed, got %d", group.Threshold, len(commitments))
+	}
+	session := &frostSession{pkey: pkey.Ed.Pkey, list: append([]*FrostCommitment{}, commitments...)}
+	sort.Slice(session.list, func(i, j int) bool {
+		return session.list[i].Identifier < session.list[j].Identifier
+	})
+
+	// encode_group_commitment_list
+	var encoded bytes.Buffer
+	for i, c := range session.list {
+		if c.Identifier < 1 || c.Identifier > frostMaxParticipants || (i > 0 && session.list[i-1].Identifier == c.Identifier) {
+			return nil, errors.New("Bad FROST commitment list")
+		}
+		hiding, err := decodeElement(c.Hiding)
+		if err != nil {
+			return nil, err
+		}
+		binding, err := decodeElement(c.Binding)
+		if err != nil {
+			return nil, err
+		}
+		session.hiding = append(session.hiding, hiding)
+		session.binding = append(session.binding, binding)
+		encoded.Write(frostIdentifier(c.Identifier).Bytes())
+		encoded.Write(c.Hiding)
+		encoded.Write(c.Binding)
+	}
+
+	// compute_binding_factors and compute_group_commitment
+	prefix := append(append([]byte{}, session.pkey...), frostHash("msg", message)...)
+	prefix = append(prefix, frostHash("com", encoded.Bytes())...)
+	scalars := make([]*edwards25519.Scalar, 0, 2*len(session.list))
+	points := make([]*edwards25519.Point, 0, 2*len(session.list))
+	for i, c := range session.list {
+		rho := frostScalar("rho", prefix, frostIdentifier(c.Identifier).Bytes())
+		session.rho = append(session.rho, rho)
+		scalars = append(scalars, scalarOne(), rho)
+		points = append(points, session.hiding[i], session.binding[i])
+	}
+	session.R = new(edwards25519.Point).VarTimeMultiScalarMult(scalars, points)
+	if session.R.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, errors.New("FROST group commitment is the identity")
+	}
+
+	// compute_challenge, plain Ed25519 so the signature verifies as one.
+	h := sha512.New()
+	h.Write(session.R.Bytes())
+	h.Write(session.pkey)
+	h.Write(message)
+	session.challenge, _ = edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	return session, nil
+}
+
+func (session *frostSession) index(identifier int) int {
+	for i, c := range session.list {
+		if c.Identifier == identifier {
+			return i
+		}
+	}
+	return -1
+}
+
+// lambda is derive_interpolating_value of identifier over the signers.
+func (session *frostSession) lambda(identifier int) *edwards25519.Scalar {
+	num, den := scalarOne(), scalarOne()
+	xi := frostIdentifier(identifier)
+	for _, c := range session.list {
+		if c.Identifier == identifier {
+			continue
+		}
+		xj := frostIdentifier(c.Identifier)
+		num.Multiply(num, xj)
+		den.Multiply(den, edwards25519.NewScalar().Subtract(xj, xi))
+	}
+	return num.Multiply(num, den.Invert(den))
+}
+
+// Encrypt seals the secret share with XChaCha20-Poly1305 under a password
+// derived key, like Skey.Encrypt.
+func (share *FrostKeyShare) Encrypt(password []byte) error {
+	if share.secret == nil {
+		return errors.New("Key share is locked")
+	}
+	key, err := share.Kdf.Key(password, chacha20poly1305.KeySize)
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	share.Version = FrostShareVersion
+	share.Skey = nil
+	share.Nonce = nonce
+	share.Box = aead.Seal(nil, nonce, share.secret, share.additionalData())
+	return nil
+}
+
+// Decrypt unlocks the share and checks it against the group commitment.
+func (share *FrostKeyShare) Decrypt(password []byte) error {
+	if share.Version != FrostShareVersion {
+		return errors.New("Unsupported key share version")
+	}
+	secret := share.Skey
+	if share.Box != nil {
+		key, err := share.Kdf.Key(password, chacha20poly1305.KeySize)
+		if err != nil {
+			return err
+		}
+		defer secmem.Wipe(key)
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return err
+		}
+		if len(share.Nonce) != aead.NonceSize() {
+			return errors.New("Bad nonce size")
+		}
+		secret, err = aead.Open(nil, share.Nonce, share.Box, share.additionalData())
+		if err != nil {
+			return errors.New("Decryption failed")
+		}
+	}
+	if len(secret) != 32 {
+		return errors.New("Bad secret key size")
+	}
+	share.setSecret(secret)
+	secmem.Wipe(secret)
+	share.Skey = nil
+	err := share.Check()
+	if err != nil {
+		share.Wipe()
+		return err
+	}
+	return nil
+}
+
+// MarshalJSON fails with ErrUnencrypted for a share that is not sealed
+// with Encrypt, see Skey.MarshalJSON.
+func (share FrostKeyShare) MarshalJSON() ([]byte, error) {
+	type plainShare FrostKeyShare
+	if share.Box == nil && (share.secret != nil || share.Skey != nil) {
+		return nil, ErrUnencrypted
+	}
+	return json.Marshal(plainShare(share))
+}
+
+// MarshalUnencrypted encodes an unlocked share in clear text.
+func (share *FrostKeyShare) MarshalUnencrypted() ([]byte, error) {
+	type plainShare FrostKeyShare
+	if share.secret == nil {
+		return nil, errors.New("Key share is locked")
+	}
+	c := *share
+	c.Nonce, c.Box = nil, nil
+	c.Skey = append([]byte{}, share.secret...)
+	defer secmem.Wipe(c.Skey)
+	return json.Marshal(plainShare(c))
+}
+
+// Wipe zeroes the secret share and locks it.
+func (share *FrostKeyShare) Wipe() {
+	if share.secret != nil {
+		secmem.Free(share.secret, share.memLocked)
+	}
+	share.secret, share.memLocked = nil, false
+}
+
+// String never shows secret material.
+func (share FrostKeyShare) String() string {
+	state := "locked"
+	if share.secret != nil {
+		state = "unlocked"
+	}
+	return fmt.Sprintf("FrostKeyShare(%x %d of %d %s)", share.ID, share.Identifier, share.Threshold, state)
+}
+
+// Format prints String for every verb.
+func (share FrostKeyShare) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, share.String())
+}
+
+func (share *FrostKeyShare) setSecret(secret []byte) {
+	share.Wipe()
+	if LockMemory {
+		share.secret, share.memLocked = secmem.Alloc(len(secret))
+	}
+	if share.secret == nil {
+		share.secret = make([]byte, len(secret))
+	}
+	copy(share.secret, secret)
+}
+
+func (share *FrostKeyShare) scalar() (*edwards25519.Scalar, error) {
+	if share.secret == nil {
+		return nil, errors.New("Key share is locked")
+	}
+	s, err := edwards25519.NewScalar().SetCanonicalBytes(share.secret)
+	if err != nil {
+		return nil, errors.New("Bad secret key share")
+	}
+	return s, nil
+}
+
+// additionalData binds every clear text field of the share to the box.
+func (share *FrostKeyShare) additionalData() []byte {
+	var ad bytes.Buffer
+	for _, v := range []int{share.Version, share.Threshold, share.Identifier,
+		share.Kdf.Rounds, share.Kdf.Memory, share.Kdf.BlockSize, share.Kdf.Parallelism} {
+		binary.Write(&ad, binary.BigEndian, uint64(v))
+	}
+	fields := [][]byte{[]byte(share.Alg), share.ID, []byte(share.Kdf.Alg), share.Kdf.Salt}
+	writeFields(&ad, append(fields, share.Commitment...))
+	return ad.Bytes()
+}
+
+// frostHash is H4 and H5 of the ciphersuite, frostScalar H1, H3 and HDKG.
+func frostHash(tag string, m ...[]byte) []byte {
+	h := sha512.New()
+	h.Write([]byte(frostContext + tag))
+	for _, b := range m {
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+func frostScalar(tag string, m ...[]byte) *edwards25519.Scalar {
+	s, _ := edwards25519.NewScalar().SetUniformBytes(frostHash(tag, m...))
+	return s
+}
+
+func frostIdentifier(i int) *edwards25519.Scalar {
+	var b [32]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(i))
+	s, _ := edwards25519.NewScalar().SetCanonicalBytes(b[:])
+	return s
+}
+
+func scalarOne() *edwards25519.Scalar {
+	return frostIdentifier(1)
+}
+
+func randomScalar() (*edwards25519.Scalar, error) {
+	var b [64]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return nil, err
+	}
+	defer secmem.Wipe(b[:])
+	return edwards25519.NewScalar().SetUniformBytes(b[:])
+}
+
+func wipeScalars(scalars []*edwards25519.Scalar) {
+	for _, s := range scalars {
+		if s != nil {
+			s.Set(edwards25519.NewScalar())
+		}
+	}
+}
+
+// evalPolynomial evaluates the polynomial with coeffs at x by Horner's
+// rule.
+func evalPolynomial(coeffs []*edwards25519.Scalar, x *edwards25519.Scalar) *edwards25519.Scalar {
+	y := edwards25519.NewScalar()
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y.MultiplyAdd(y, x, coeffs[i])
+	}
+	return y
+}
+
+func vssCommit(coeffs []*edwards25519.Scalar) [][]byte {
+	commitment := make([][]byte, len(coeffs))
+	for i, c := range coeffs {
+		commitment[i] = new(edwards25519.Point).ScalarBaseMult(c).Bytes()
+	}
+	return commitment
+}
+
+// decodeElement is DeserializeElement of the ciphersuite: a canonical
+// encoding of a point of the prime order subgroup other than the identity.
+func decodeElement(b []byte) (*edwards25519.Point, error) {
+	p, err := decodePoint(b)
+	if err != nil {
+		return nil, err
+	}
+	if p.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, errors.New("Identity element")
+	}
+	// [L]p = [L-1]p + p is the identity only in the prime order subgroup.
+	minusOne := edwards25519.NewScalar().Negate(scalarOne())
+	check := new(edwards25519.Point).ScalarMult(minusOne, p)
+	if check.Add(check, p).Equal(edwards25519.NewIdentityPoint()) != 1 {
+		return nil, errors.New("Element not in the prime order subgroup")
+	}
+	return p, nil
+}
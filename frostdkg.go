@@ -0,0 +1,204 @@
+package cryptostack
+
+import (
+	"errors"
+	"fmt"
+
+	"filippo.io/edwards25519"
+)
+
+// FrostDKG is one participant of the distributed key generation of the
+// FROST paper, so no dealer ever knows the group secret. Every participant
+// broadcasts its FrostDKGCommitment, then sends each other participant its
+// FrostDKGShare over a private channel.
+type FrostDKG struct {
+	Identifier   int
+	Threshold    int
+	Participants int
+
+	coeffs      []*edwards25519.Scalar
+	commitment  [][]byte
+	commitments map[int][][]byte
+}
+
+// FrostDKGCommitment is broadcast in round one: the commitment to the
+// polynomial of a participant with a proof of knowledge of its secret.
+type FrostDKGCommitment struct {
+	Identifier int      `json:"identifier"`
+	Commitment [][]byte `json:"commitment"`
+	ProofR     []byte   `json:"proofr"`
+	ProofZ     []byte   `json:"proofz"`
+}
+
+// FrostDKGShare is the secret share From sends To in round two.
+type FrostDKGShare struct {
+	From  int    `json:"from"`
+	To    int    `json:"to"`
+	Value []byte `json:"value"`
+}
+
+// NewFrostDKG starts the key generation of participant identifier, one of
+// n numbered from 1, and returns its round one message.
+func NewFrostDKG(identifier, threshold, n int) (*FrostDKG, *FrostDKGCommitment, error) {
+	if threshold < 2 || n < threshold || n > frostMaxParticipants || identifier < 1 || identifier > n {
+		return nil, nil, errors.New("Bad FROST threshold or participant count")
+	}
+	dkg := &FrostDKG{Identifier: identifier, Threshold: threshold, Participants: n}
+	dkg.coeffs = make([]*edwards25519.Scalar, threshold)
+	for i := range dkg.coeffs {
+		var err error
+		dkg.coeffs[i], err = randomScalar()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	dkg.commitment = vssCommit(dkg.coeffs)
+
+	// Schnorr proof of knowledge of the constant term, against rogue key
+	// attacks.
+	k, err := randomScalar()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer k.Set(edwards25519.NewScalar())
+	R := new(edwards25519.Point).ScalarBaseMult(k).Bytes()
+	c := dkgChallenge(identifier, dkg.commitment[0], R)
+	z := edwards25519.NewScalar().MultiplyAdd(dkg.coeffs[0], c, k)
+	return dkg, &FrostDKGCommitment{
+		Identifier: identifier,
+		Commitment: dkg.commitment,
+		ProofR:     R,
+		ProofZ:     z.Bytes(),
+	}, nil
+}
+
+// Round2 checks the round one messages of all other participants and
+// returns the shares to send them.
+func (dkg *FrostDKG) Round2(commitments []*FrostDKGCommitment) ([]*FrostDKGShare, error) {
+	if dkg.coeffs == nil {
+		return nil, errors.New("FROST key generation is finished")
+	}
+	dkg.commitments = map[int][][]byte{}
+	for _, c := range commitments {
+		if c.Identifier == dkg.Identifier {
+			continue
+		}
+		if c.Identifier < 1 || c.Identifier > dkg.Participants || dkg.commitments[c.Identifier] != nil {
+			return nil, fmt.Errorf("Bad commitment of participant %d", c.Identifier)
+		}
+		err := c.verify(dkg.Threshold)
+		if err != nil {
+			return nil, fmt.Errorf("Participant %d: %s", c.Identifier, err)
+		}
+		dkg.commitments[c.Identifier] = c.Commitment
+	}
+	if len(dkg.commitments) != dkg.Participants-1 {
+		return nil, errors.New("Commitments of all participants are needed")
+	}
+
+	var shares []*FrostDKGShare
+	for i := 1; i <= dkg.Participants; i++ {
+		if i != dkg.Identifier {
+			y := evalPolynomial(dkg.coeffs, frostIdentifier(i))
+			shares = append(shares, &FrostDKGShare{From: dkg.Identifier, To: i, Value: y.Bytes()})
+		}
+	}
+	return shares, nil
+}
+
+// Finish checks the shares received from all other participants against
+// their commitments and returns the key share of this participant.
+func (dkg *FrostDKG) Finish(shares []*FrostDKGShare) (*FrostKeyShare, error) {
+	if dkg.coeffs == nil {
+		return nil, errors.New("FROST key generation is finished")
+	}
+	if dkg.commitments == nil {
+		return nil, errors.New("FROST round two is not done")
+	}
+	secret := evalPolynomial(dkg.coeffs, frostIdentifier(dkg.Identifier))
+	defer secret.Set(edwards25519.NewScalar())
+	seen := map[int]bool{}
+	for _, share := range shares {
+		commitment := dkg.commitments[share.From]
+		if share.To != dkg.Identifier || commitment == nil || seen[share.From] {
+			return nil, fmt.Errorf("Bad share from participant %d", share.From)
+		}
+		seen[share.From] = true
+		y, err := edwards25519.NewScalar().SetCanonicalBytes(share.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Bad share from participant %d", share.From)
+		}
+		pub, err := (&FrostGroup{Threshold: dkg.Threshold, Commitment: commitment}).verifyingShare(dkg.Identifier)
+		if err != nil {
+			return nil, err
+		}
+		if new(edwards25519.Point).ScalarBaseMult(y).Equal(pub) != 1 {
+			return nil, fmt.Errorf("Share from participant %d doesn't match its commitment", share.From)
+		}
+		secret.Add(secret, y)
+		y.Set(edwards25519.NewScalar())
+	}
+	if len(seen) != dkg.Participants-1 {
+		return nil, errors.New("Shares of all participants are needed")
+	}
+
+	// The group commitment is the sum of the commitments of all.
+	sum := make([]*edwards25519.Point, dkg.Threshold)
+	for j := range sum {
+		sum[j], _ = decodeElement(dkg.commitment[j])
+		for _, commitment := range dkg.commitments {
+			p, _ := decodeElement(commitment[j])
+			sum[j].Add(sum[j], p)
+		}
+	}
+	group := &FrostGroup{Threshold: dkg.Threshold}
+	for _, p := range sum {
+		if p.Equal(edwards25519.NewIdentityPoint()) == 1 {
+			return nil, errors.New("FROST group commitment is the identity")
+		}
+		group.Commitment = append(group.Commitment, p.Bytes())
+	}
+	group.ID = importKeyID(group.Commitment[0])
+
+	share, err := newFrostKeyShare(group, dkg.Identifier, secret)
+	if err != nil {
+		return nil, err
+	}
+	wipeScalars(dkg.coeffs)
+	dkg.coeffs = nil
+	return share, nil
+}
+
+func (c *FrostDKGCommitment) verify(threshold int) error {
+	if len(c.Commitment) != threshold {
+		return errors.New("Bad commitment length")
+	}
+	for _, e := range c.Commitment {
+		_, err := decodeElement(e)
+		if err != nil {
+			return err
+		}
+	}
+	R, err := decodeElement(c.ProofR)
+	if err != nil {
+		return err
+	}
+	z, err := edwards25519.NewScalar().SetCanonicalBytes(c.ProofZ)
+	if err != nil {
+		return err
+	}
+	// R = [z]B - [c]C_0
+	C0, _ := decodeElement(c.Commitment[0])
+	challenge := dkgChallenge(c.Identifier, c.Commitment[0], c.ProofR)
+	check := new(edwards25519.Point).VarTimeDoubleScalarBaseMult(edwards25519.NewScalar().Negate(challenge), C0, z)
+	if check.Equal(R) != 1 {
+		return errors.New("Bad proof of knowledge")
+	}
+	return nil
+}
+
+// dkgChallenge is HDKG(identifier || C_0 || R), as in the FROST reference
+// implementation.
+func dkgChallenge(identifier int, C0, R []byte) *edwards25519.Scalar {
+	return frostScalar("dkg", frostIdentifier(identifier).Bytes(), C0, R)
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package secmem
+
+func alloc(n int) ([]byte, bool) {
+	return nil, false
+}
+
+func unlock(b []byte) {}
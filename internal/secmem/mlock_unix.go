@@ -0,0 +1,33 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package secmem
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// alloc takes whole pages out of a larger heap buffer. The Go collector
+// doesn't move objects, so the pages stay where they were locked.
+func alloc(n int) ([]byte, bool) {
+	page := os.Getpagesize()
+	size := (n + page - 1) / page * page
+	if size == 0 {
+		size = page
+	}
+	buf := make([]byte, size+page)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(page)); rem != 0 {
+		off = page - rem
+	}
+	b := buf[off : off+size]
+	if syscall.Mlock(b) != nil {
+		return nil, false
+	}
+	return b[:n:size], true
+}
+
+func unlock(b []byte) {
+	syscall.Munlock(b[:cap(b)])
+}
@@ -0,0 +1,34 @@
+// Package secmem keeps secrets in memory that is wiped after use and, where
+// the system allows it, locked so it is never written to swap.
+package secmem
+
+import "runtime"
+
+// Wipe overwrites b with zeros.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
+
+// Alloc returns n bytes of memory locked with mlock, or of ordinary memory
+// if locking is not supported or not permitted, e.g. because of
+// RLIMIT_MEMLOCK. The buffer has pages of its own, so Free never unlocks
+// memory of another buffer. It is still garbage collected, Free only wipes
+// and unlocks it.
+func Alloc(n int) (b []byte, locked bool) {
+	b, locked = alloc(n)
+	if b == nil {
+		b = make([]byte, n)
+	}
+	return b, locked
+}
+
+// Free wipes b and unlocks it if it was allocated locked.
+func Free(b []byte, locked bool) {
+	Wipe(b)
+	if locked {
+		unlock(b)
+	}
+}
@@ -0,0 +1,203 @@
+package cryptostack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	JWKCrvEd25519 = "Ed25519"
+	JWKCrvX25519  = "X25519"
+)
+
+// JWK is an RFC 8037 OKP JSON Web Key. Like in PKCS#8, the Ed25519 and
+// X25519 halves of a key are separate JWKs. Kid is set to the RFC 7638
+// thumbprint by the functions producing JWKs.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	D   string `json:"d,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+// JWK returns the Ed25519 half of pkey as a signature key and the X25519
+// half as an encryption key.
+func (pkey *Pkey) JWK() (ed *JWK, curve *JWK, err error) {
+	curvePkey := pkey.GetCurveKey()
+	if curvePkey == nil {
+		return nil, nil, errors.New("Bad curve25519 public key")
+	}
+	ed = newJWK(JWKCrvEd25519, pkey.GetEdKey()[:], nil)
+	curve = newJWK(JWKCrvX25519, curvePkey[:], nil)
+	return ed, curve, nil
+}
+
+// JWK returns the halves of skey as private JWKs. The Ed25519 "d" is the
+// 32 byte seed of the key.
+func (skey *Skey) JWK() (ed *JWK, curve *JWK, err error) {
+	if skey.edSkey == nil || skey.curveSkey == nil {
+		return nil, nil, errors.New("Key is locked")
+	}
+	pkey := skey.GetPkey()
+	ed = newJWK(JWKCrvEd25519, pkey.GetEdKey()[:], skey.edSkey[:32])
+	curve = newJWK(JWKCrvX25519, pkey.GetCurveKey()[:], skey.curveSkey[:])
+	return ed, curve, nil
+}
+
+func newJWK(crv string, x, d []byte) *JWK {
+	jwk := &JWK{Kty: "OKP", Crv: crv, X: base64.RawURLEncoding.EncodeToString(x)}
+	if d != nil {
+		jwk.D = base64.RawURLEncoding.EncodeToString(d)
+	}
+	if crv == JWKCrvEd25519 {
+		jwk.Use, jwk.Alg = "sig", "EdDSA"
+	} else {
+		jwk.Use, jwk.Alg = "enc", "ECDH-ES"
+	}
+	jwk.Kid, _ = jwk.Thumbprint()
+	return jwk
+}
+
+// Thumbprint returns the RFC 7638 SHA-256 thumbprint of jwk, base64url
+// encoded.
+func (jwk *JWK) Thumbprint() (string, error) {
+	if jwk.Kty != "OKP" {
+		return "", errors.New("Unsupported JWK key type")
+	}
+	// Required members only, in lexicographic order and without
+	// whitespace.
+	buf, err := json.Marshal(struct {
+		Crv string `json:"crv"`
+		Kty string `json:"kty"`
+		X   string `json:"x"`
+	}{jwk.Crv, jwk.Kty, jwk.X})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func (jwk *JWK) decode(crv string) (x []byte, d []byte, err error) {
+	if jwk.Kty != "OKP" || jwk.Crv != crv {
+		return nil, nil, errors.New("Not an OKP " + crv + " key")
+	}
+	x, err = base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, nil, err
+	}
+	if jwk.D != "" {
+		d, err = base64.RawURLEncoding.DecodeString(jwk.D)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(x) != 32 || (d != nil && len(d) != 32) {
+		return nil, nil, errors.New("Bad " + crv + " key length")
+	}
+	return x, d, nil
+}
+
+// ParseJWK builds a public key from JWKs, private members are ignored.
+// Without curve, or if curve is the one derived from ed, the result is an
+// AlgEd25519 key.
+func ParseJWK(ed *JWK, curve *JWK) (*Pkey, error) {
+	edPkey, _, err := ed.decode(JWKCrvEd25519)
+	if err != nil {
+		return nil, err
+	}
+	pkey := importEdPkey(edPkey, importKeyID(edPkey))
+	if curve == nil {
+		return pkey, nil
+	}
+	x, _, err := curve.decode(JWKCrvX25519)
+	if err != nil {
+		return nil, err
+	}
+	if derived := pkey.GetCurveKey(); derived != nil && bytes.Equal(derived[:], x) {
+		return pkey, nil
+	}
+	curvePkey := &[32]byte{}
+	copy(curvePkey[:], x)
+	pkey = NewPkey(curvePkey, pkey.GetEdKey())
+	pkey.ID = importKeyID(edPkey)
+	return pkey, nil
+}
+
+// ParseSkeyJWK builds a secret key from private JWKs. Without curve the
+// X25519 key is derived from ed.
+func ParseSkeyJWK(ed *JWK, curve *JWK) (*Skey, error) {
+	x, d, err := ed.decode(JWKCrvEd25519)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, errors.New("Not a private JWK")
+	}
+	skey, err := importEdSkey(append(d, x...), importKeyID(x))
+	if err != nil || curve == nil {
+		return skey, err
+	}
+	x, d, err = curve.decode(JWKCrvX25519)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, errors.New("Not a private JWK")
+	}
+	curvePkey, err := curve25519.X25519(d, curve25519.Basepoint)
+	if err != nil || !bytes.Equal(curvePkey, x) {
+		return nil, errors.New("Bad X25519 private key")
+	}
+	if bytes.Equal(x, skey.GetPkey().GetCurveKey()[:]) {
+		return skey, nil
+	}
+	curveKey := &[32]byte{}
+	copy(curveKey[:], x)
+	curveSkey := &[32]byte{}
+	copy(curveSkey[:], d)
+	return newSkey(NewPkey(curveKey, skey.GetPkey().GetEdKey()), curveSkey, skey.edSkey, skey.ID, &skey.Kdf), nil
+}
+
+// JWKSet is an RFC 7517 JWK Set.
+type JWKSet struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// Add appends the public JWKs of pkey to the set.
+func (set *JWKSet) Add(pkey *Pkey) error {
+	ed, curve, err := pkey.JWK()
+	if err != nil {
+		return err
+	}
+	set.Keys = append(set.Keys, ed, curve)
+	return nil
+}
+
+// Key returns the key with kid, or nil.
+func (set *JWKSet) Key(kid string) *JWK {
+	for _, jwk := range set.Keys {
+		if jwk.Kid == kid {
+			return jwk
+		}
+	}
+	return nil
+}
+
+// Pkey returns the verification key for the Ed25519 JWK with kid, e.g. the
+// kid of a JWT header.
+func (set *JWKSet) Pkey(kid string) (*Pkey, error) {
+	jwk := set.Key(kid)
+	if jwk == nil {
+		return nil, errors.New("Key not found")
+	}
+	return ParseJWK(jwk, nil)
+}
@@ -0,0 +1,144 @@
+package cryptostack
+
+import (
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	KdfPbkdf2Blake2b = "pbkdf2-blake2b"
+	KdfArgon2id      = "argon2id"
+	KdfScrypt        = "scrypt"
+)
+
+// Kdf describes how a password is stretched into a key. Rounds is the
+// iteration count for pbkdf2, the time cost for argon2id and N for scrypt.
+// Memory is in KiB and is used by argon2id only, BlockSize is scrypt's r.
+type Kdf struct {
+	Alg         string `json:"alg"`
+	Salt        []byte `json:"salt"`
+	Rounds      int    `json:"rounds"`
+	Memory      int    `json:"memory,omitempty"`
+	BlockSize   int    `json:"blocksize,omitempty"`
+	Parallelism int    `json:"parallelism,omitempty"`
+}
+
+func NewKdf(alg string) (*Kdf, error) {
+	kdf := &Kdf{Alg: alg}
+	switch alg {
+	case KdfPbkdf2Blake2b:
+		kdf.Rounds = 4096
+	case KdfArgon2id:
+		kdf.Rounds = 3
+		kdf.Memory = 64 * 1024
+		kdf.Parallelism = 4
+	case KdfScrypt:
+		kdf.Rounds = 1 << 15
+		kdf.BlockSize = 8
+		kdf.Parallelism = 1
+	default:
+		return nil, errors.New("Unknown kdf algorithm")
+	}
+	kdf.Salt = make([]byte, 32)
+	_, err := rand.Read(kdf.Salt)
+	if err != nil {
+		return nil, err
+	}
+	return kdf, nil
+}
+
+func (kdf *Kdf) Key(password []byte, l int) ([]byte, error) {
+	switch kdf.Alg {
+	case KdfPbkdf2Blake2b:
+		if kdf.Rounds < 1 || kdf.Rounds > maxPbkdf2Rounds {
+			return nil, errors.New("Bad kdf parameters")
+		}
+		return pbkdf2.Key(password, kdf.Salt, kdf.Rounds, l, blake2b.New512), nil
+	case KdfArgon2id:
+		if kdf.Rounds < 1 || kdf.Rounds > maxArgon2Rounds || kdf.Parallelism < 1 || kdf.Parallelism > 255 ||
+			kdf.Memory < 8*kdf.Parallelism || kdf.Memory > maxArgon2Memory {
+			return nil, errors.New("Bad kdf parameters")
+		}
+		return argon2.IDKey(password, kdf.Salt, uint32(kdf.Rounds), uint32(kdf.Memory), uint8(kdf.Parallelism), uint32(l)), nil
+	case KdfScrypt:
+		// N is a power of two and scrypt takes 128*r*N bytes.
+		if kdf.Rounds < 2 || kdf.Rounds&(kdf.Rounds-1) != 0 || kdf.Rounds > maxScryptRounds ||
+			kdf.BlockSize < 1 || kdf.Parallelism < 1 || kdf.BlockSize*kdf.Parallelism > maxScryptBlocks ||
+			128*int64(kdf.BlockSize)*int64(kdf.Rounds) > maxScryptMemory {
+			return nil, errors.New("Bad kdf parameters")
+		}
+		return scrypt.Key(password, kdf.Salt, kdf.Rounds, kdf.BlockSize, kdf.Parallelism, l)
+	}
+	return nil, errors.New("Unknown kdf algorithm")
+}
+
+// Limits on the parameters of a kdf, which come with the untrusted key
+// file. maxArgon2Memory is 4 GiB in KiB, maxScryptMemory 1 GiB, which
+// maxScryptRounds reaches with the default block size.
+const (
+	maxPbkdf2Rounds = 1 << 24
+	maxArgon2Rounds = 1 << 10
+	maxArgon2Memory = 4 << 20
+	maxScryptRounds = 1 << 20
+	maxScryptBlocks = 64
+	maxScryptMemory = 1 << 30
+)
+
+func maxKdfRounds(alg string) int {
+	switch alg {
+	case KdfArgon2id:
+		return maxArgon2Rounds
+	case KdfScrypt:
+		return maxScryptRounds
+	}
+	return maxPbkdf2Rounds
+}
+
+// CalibrateKdf returns a kdf of alg whose Rounds are tuned so that deriving
+// a key takes about target on this machine. Other parameters keep the
+// NewKdf defaults and Rounds never go below them.
+func CalibrateKdf(alg string, target time.Duration) (*Kdf, error) {
+	kdf, err := NewKdf(alg)
+	if err != nil {
+		return nil, err
+	}
+	minRounds := kdf.Rounds
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		_, err = kdf.Key([]byte("calibration"), 32)
+		if err != nil {
+			return nil, err
+		}
+		elapsed := time.Since(start)
+		if elapsed <= 0 {
+			elapsed = 1
+		}
+		scaled := float64(kdf.Rounds) * float64(target) / float64(elapsed)
+		if limit := maxKdfRounds(alg); scaled > float64(limit) {
+			scaled = float64(limit)
+		}
+		rounds := int(scaled)
+		if alg == KdfScrypt {
+			// N must be a power of two.
+			n := minRounds
+			for n < maxScryptRounds && n*3/2 < rounds {
+				n <<= 1
+			}
+			rounds = n
+		}
+		if rounds < minRounds {
+			rounds = minRounds
+		}
+		if rounds == kdf.Rounds || (rounds > kdf.Rounds*9/10 && rounds < kdf.Rounds*11/10) {
+			break
+		}
+		kdf.Rounds = rounds
+	}
+	return kdf, nil
+}
@@ -0,0 +1,324 @@
+package cryptostack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Trust is the trust level of a keyring entry. Only TrustMarginal and above
+// are used to verify signatures.
+type Trust int
+
+const (
+	TrustUnknown Trust = iota
+	TrustNever
+	TrustMarginal
+	TrustFull
+	TrustUltimate
+)
+
+var trustNames = []string{"unknown", "never", "marginal", "full", "ultimate"}
+
+func (t Trust) String() string {
+	if t < 0 || int(t) >= len(trustNames) {
+		return "unknown"
+	}
+	return trustNames[t]
+}
+
+func ParseTrust(name string) (Trust, error) {
+	for i, n := range trustNames {
+		if n == name {
+			return Trust(i), nil
+		}
+	}
+	return TrustUnknown, errors.New("Unknown trust level " + name)
+}
+
+func (t Trust) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *Trust) UnmarshalText(text []byte) error {
+	var err error
+	*t, err = ParseTrust(string(text))
+	return err
+}
+
+// KeyringEntry is a public key with an optional secret key, which is stored
+// as is, so it should be encrypted.
+type KeyringEntry struct {
+	Label string `json:"label,omitempty"`
+	Trust Trust  `json:"trust"`
+	Pkey  *Pkey  `json:"pkey"`
+	Skey  *Skey  `json:"skey,omitempty"`
+}
+
+// clone returns a copy of entry whose keys share no memory with it, so a
+// caller may decrypt its secret key without touching the keyring.
+func (entry *KeyringEntry) clone() *KeyringEntry {
+	c := *entry
+	c.Pkey = entry.Pkey.clone()
+	if entry.Skey != nil {
+		c.Skey = entry.Skey.clone()
+	}
+	return &c
+}
+
+// Keyring is a set of keys indexed by ID and stored either in a single json
+// file or in a directory with a file per key. Every change is written at
+// once, files are replaced through a rename so other processes never read a
+// partial keyring.
+type Keyring struct {
+	path    string
+	dir     bool
+	mu      sync.RWMutex
+	entries map[string]*KeyringEntry
+}
+
+type keyringFile struct {
+	Keys []*KeyringEntry `json:"keys"`
+}
+
+// OpenKeyring loads the keyring at path. An existing directory is used as a
+// directory keyring, otherwise path is a keyring file, created on the first
+// change if it doesn't exist.
+func OpenKeyring(path string) (*Keyring, error) {
+	kr := &Keyring{path: path, entries: map[string]*KeyringEntry{}}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return kr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []*KeyringEntry
+	if info.IsDir() {
+		kr.dir = true
+		names, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			entry := &KeyringEntry{}
+			err = readJSONFile(name, entry)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	} else {
+		file := keyringFile{}
+		err = readJSONFile(path, &file)
+		if err != nil {
+			return nil, err
+		}
+		entries = file.Keys
+	}
+	for _, entry := range entries {
+		if entry.Pkey == nil || len(entry.Pkey.ID) == 0 {
+			return nil, errors.New("Keyring entry without public key")
+		}
+		kr.entries[string(entry.Pkey.ID)] = entry
+	}
+	return kr, nil
+}
+
+// Add stores a new entry. If entry has only a secret key, its public key is
+// taken from it.
+func (kr *Keyring) Add(entry KeyringEntry) error {
+	if entry.Pkey == nil && entry.Skey != nil {
+		entry.Pkey = entry.Skey.GetPkey()
+	}
+	if entry.Pkey == nil || len(entry.Pkey.ID) == 0 {
+		return errors.New("Keyring entry without public key")
+	}
+	if entry.Skey != nil && (!bytes.Equal(entry.Skey.ID, entry.Pkey.ID) || !bytes.Equal(entry.Skey.Ed.Pkey, entry.Pkey.Ed.Pkey)) {
+		return errors.New("Secret key doesn't match public key")
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	id := string(entry.Pkey.ID)
+	if _, ok := kr.entries[id]; ok {
+		return errors.New("Key is already in the keyring")
+	}
+	kr.entries[id] = &entry
+	err := kr.save(&entry)
+	if err != nil {
+		delete(kr.entries, id)
+	}
+	return err
+}
+
+func (kr *Keyring) Remove(id []byte) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	entry, ok := kr.entries[string(id)]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	delete(kr.entries, string(id))
+	var err error
+	if kr.dir {
+		err = os.Remove(kr.entryFile(id))
+	} else {
+		err = kr.save(nil)
+	}
+	if err != nil {
+		kr.entries[string(id)] = entry
+	}
+	return err
+}
+
+// Get returns a copy of the entry with id, or nil.
+func (kr *Keyring) Get(id []byte) *KeyringEntry {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	entry, ok := kr.entries[string(id)]
+	if !ok {
+		return nil
+	}
+	return entry.clone()
+}
+
+// Find returns the entries labeled name or whose hex ID starts with name.
+func (kr *Keyring) Find(name string) []*KeyringEntry {
+	if name == "" {
+		return nil
+	}
+	var found []*KeyringEntry
+	for _, entry := range kr.List() {
+		if entry.Label == name || strings.HasPrefix(hex.EncodeToString(entry.Pkey.ID), strings.ToLower(name)) {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// List returns copies of all entries sorted by ID.
+func (kr *Keyring) List() []*KeyringEntry {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	list := make([]*KeyringEntry, 0, len(kr.entries))
+	for _, entry := range kr.entries {
+		list = append(list, entry.clone())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return bytes.Compare(list[i].Pkey.ID, list[j].Pkey.ID) < 0
+	})
+	return list
+}
+
+func (kr *Keyring) SetTrust(id []byte, trust Trust) error {
+	return kr.update(id, func(entry *KeyringEntry) { entry.Trust = trust })
+}
+
+func (kr *Keyring) SetLabel(id []byte, label string) error {
+	return kr.update(id, func(entry *KeyringEntry) { entry.Label = label })
+}
+
+func (kr *Keyring) update(id []byte, f func(*KeyringEntry)) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	entry, ok := kr.entries[string(id)]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	c := *entry
+	f(&c)
+	kr.entries[string(id)] = &c
+	err := kr.save(&c)
+	if err != nil {
+		kr.entries[string(id)] = entry
+	}
+	return err
+}
+
+// Lookup returns the public key with id if it is trusted at least
+// marginally.
+func (kr *Keyring) Lookup(id []byte) (*Pkey, error) {
+	entry := kr.Get(id)
+	if entry == nil {
+		return nil, ErrKeyNotFound
+	}
+	if entry.Trust < TrustMarginal {
+		return nil, ErrKeyNotTrusted
+	}
+	return entry.Pkey, nil
+}
+
+// Verify resolves the signing key of sig by its ID and verifies sig with
+// the keyring copy of the key, not the one embedded in sig.
+func (kr *Keyring) Verify(sig *Signature, r io.Reader) (*SignatureMeta, error) {
+	if sig.Pkey == nil {
+		return nil, ErrKeyNotFound
+	}
+	pkey, err := kr.Lookup(sig.Pkey.ID)
+	if err != nil {
+		return nil, err
+	}
+	c := *sig
+	c.Pkey = pkey
+	return c.Verify(r)
+}
+
+// save writes entry, or the whole keyring if entry is nil or the keyring
+// is a file. The caller holds the write lock.
+func (kr *Keyring) save(entry *KeyringEntry) error {
+	if kr.dir && entry != nil {
+		return writeJSONFile(kr.entryFile(entry.Pkey.ID), entry)
+	}
+	file := keyringFile{}
+	for _, entry := range kr.entries {
+		file.Keys = append(file.Keys, entry)
+	}
+	sort.Slice(file.Keys, func(i, j int) bool {
+		return bytes.Compare(file.Keys[i].Pkey.ID, file.Keys[j].Pkey.ID) < 0
+	})
+	return writeJSONFile(kr.path, file)
+}
+
+func (kr *Keyring) entryFile(id []byte) string {
+	return filepath.Join(kr.path, hex.EncodeToString(id)+".json")
+}
+
+func readJSONFile(name string, v interface{}) error {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func writeJSONFile(name string, v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", " ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
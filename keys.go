@@ -2,14 +2,46 @@ package cryptostack
 
 import (
 	"bytes"
+	"crypto"
+	stded25519 "crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"hash"
 	"io"
+	"time"
 
+	"github.com/ArtemKulyabin/cryptostack/internal/secmem"
 	"github.com/agl/ed25519"
 	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/nacl/box"
-	"golang.org/x/crypto/pbkdf2"
+)
+
+// Signature algorithms, the Ed25519 variants of RFC 8032.
+const (
+	SigAlgEd25519    = "ed25519"
+	SigAlgEd25519ph  = "ed25519ph"
+	SigAlgEd25519ctx = "ed25519ctx"
+)
+
+// Contexts of the Ed25519ctx signatures made by this package, one for each
+// purpose, so a signature made for one is never valid for another.
+const (
+	ContextFile        = "cryptostack file"
+	ContextStatement   = "statement"
+	ContextCertificate = "certificate"
+	ContextMeta        = "meta"
+	ContextKeyMeta     = "key meta"
+)
+
+const (
+	AlgCurveEd = "curve25519-ed25519"
+	// AlgEd25519 keys have a single Ed25519 keypair, the Curve25519 keypair
+	// is derived from it with EdPkeyToCurve and EdSkeyToCurve.
+	AlgEd25519 = "ed25519"
 )
 
 type Pkey struct {
@@ -21,13 +53,16 @@ type Pkey struct {
 	Ed struct {
 		Pkey []byte `json:"pkey"`
 	} `json:"ed"`
+	Meta *KeyMeta `json:"meta,omitempty"`
 
 	curvePkey *[32]byte
 	edPkey    *[32]byte
+	// embedded is set for keys read as part of a Signature.
+	embedded bool
 }
 
 func NewPkey(curvePkey *[32]byte, edPkey *[32]byte) *Pkey {
-	pkey := &Pkey{Alg: "curve25519-ed25519"}
+	pkey := &Pkey{Alg: AlgCurveEd}
 	pkey.Curve.Pkey = curvePkey[:]
 	pkey.Ed.Pkey = edPkey[:]
 	pkey.curvePkey = curvePkey
@@ -35,7 +70,53 @@ func NewPkey(curvePkey *[32]byte, edPkey *[32]byte) *Pkey {
 	return pkey
 }
 
+func NewEdPkey(edPkey *[32]byte) *Pkey {
+	pkey := &Pkey{Alg: AlgEd25519}
+	pkey.Ed.Pkey = edPkey[:]
+	pkey.edPkey = edPkey
+	return pkey
+}
+
+// clone returns a copy of pkey sharing no memory with it, or nil.
+func (pkey *Pkey) clone() *Pkey {
+	if pkey == nil {
+		return nil
+	}
+	c := *pkey
+	c.curvePkey, c.edPkey = nil, nil
+	c.ID = append([]byte(nil), pkey.ID...)
+	c.Curve.Pkey = append([]byte(nil), pkey.Curve.Pkey...)
+	c.Ed.Pkey = append([]byte(nil), pkey.Ed.Pkey...)
+	c.Meta = pkey.Meta.clone()
+	return &c
+}
+
+// MarshalJSON omits the derived curve key of AlgEd25519 keys.
+func (pkey Pkey) MarshalJSON() ([]byte, error) {
+	type plainPkey Pkey
+	if pkey.Alg != AlgEd25519 {
+		return json.Marshal(plainPkey(pkey))
+	}
+	return json.Marshal(struct {
+		Alg string `json:"alg"`
+		ID  []byte `json:"id"`
+		Ed  struct {
+			Pkey []byte `json:"pkey"`
+		} `json:"ed"`
+		Meta *KeyMeta `json:"meta,omitempty"`
+	}{pkey.Alg, pkey.ID, pkey.Ed, pkey.Meta})
+}
+
+// GetCurveKey returns nil if the curve key of an AlgEd25519 key can't be
+// derived because the Ed25519 key is not a valid point.
 func (pkey Pkey) GetCurveKey() *[32]byte {
+	if pkey.curvePkey == nil && pkey.Alg == AlgEd25519 {
+		curvePkey, err := EdPkeyToCurve(pkey.GetEdKey())
+		if err != nil {
+			return nil
+		}
+		pkey.curvePkey = curvePkey
+	}
 	if pkey.curvePkey == nil {
 		pkey.curvePkey = &[32]byte{}
 		copy(pkey.curvePkey[:], pkey.Curve.Pkey)
@@ -53,7 +134,47 @@ func (pkey Pkey) GetEdKey() *[32]byte {
 	return &edPkey
 }
 
+// Verify fails with ErrKeyExpired or ErrKeyUsage if the key metadata
+// doesn't allow signing.
 func (pkey *Pkey) Verify(message []byte, sig []byte) error {
+	err := pkey.CheckUsage(UsageSign)
+	if err != nil {
+		return err
+	}
+	return pkey.verify(message, sig)
+}
+
+// VerifyWithContext verifies a signature made by Skey.SignWithContext.
+func (pkey *Pkey) VerifyWithContext(message []byte, sig []byte, alg string, context string) error {
+	err := pkey.CheckUsage(UsageSign)
+	if err != nil {
+		return err
+	}
+	if alg == SigAlgEd25519 && context == "" {
+		return pkey.verify(message, sig)
+	}
+	opts, err := ed25519Options(alg, context)
+	if err != nil {
+		return err
+	}
+	err = stded25519.VerifyWithOptions(pkey.GetEdKey()[:], message, sig, opts)
+	if err != nil {
+		return errors.New("Verify failed")
+	}
+	return nil
+}
+
+// verifyContext checks a SigAlgEd25519ctx signature made for context,
+// without checking the key usage.
+func (pkey *Pkey) verifyContext(message []byte, sig []byte, context string) error {
+	err := stded25519.VerifyWithOptions(pkey.GetEdKey()[:], message, sig, &stded25519.Options{Context: context})
+	if err != nil {
+		return errors.New("Verify failed")
+	}
+	return nil
+}
+
+func (pkey *Pkey) verify(message []byte, sig []byte) error {
 	if len(sig) != 64 {
 		return errors.New("Signature size not equal 64")
 	}
@@ -65,33 +186,51 @@ func (pkey *Pkey) Verify(message []byte, sig []byte) error {
 	return nil
 }
 
+// SkeyVersion is the current secret key file format. Version 2 keeps the
+// secret keys in an authenticated box, earlier keys have no version field.
+const SkeyVersion = 2
+
 type Skey struct {
-	Alg string `json:"alg"`
-	ID  []byte `json:"id"`
-	Kdf struct {
-		Alg    string `json:"alg"`
-		Salt   []byte `json:"salt"`
-		Rounds int    `json:"rounds"`
-	} `json:"kdf"`
-	Curve struct {
+	Version int    `json:"version,omitempty"`
+	Alg     string `json:"alg"`
+	ID      []byte `json:"id"`
+	Kdf     Kdf    `json:"kdf"`
+	Curve   struct {
 		Pkey []byte `json:"pkey"`
-		Skey []byte `json:"skey"`
+		Skey []byte `json:"skey,omitempty"`
 	} `json:"curve"`
 	Ed struct {
 		Pkey []byte `json:"pkey"`
-		Skey []byte `json:"skey"`
+		Skey []byte `json:"skey,omitempty"`
 	} `json:"ed"`
-	Checksum []byte `json:"checksum"`
+	Meta     *KeyMeta `json:"meta,omitempty"`
+	Nonce    []byte   `json:"nonce,omitempty"`
+	Box      []byte   `json:"box,omitempty"`
+	Checksum []byte   `json:"checksum,omitempty"`
 
 	pkey      *Pkey
 	curveSkey *[32]byte
 	edSkey    *[64]byte
+	mem       *secret
 }
 
+// GetPkey returns the public key, of a locked key it is made from the
+// public halves kept in clear text.
 func (skey Skey) GetPkey() *Pkey {
-	return skey.pkey
+	if skey.pkey != nil || len(skey.Ed.Pkey) == 0 {
+		return skey.pkey
+	}
+	pkey := &Pkey{Alg: skey.Alg, ID: append([]byte(nil), skey.ID...), Meta: skey.Meta.clone()}
+	if skey.Alg != AlgEd25519 {
+		pkey.Curve.Pkey = append([]byte(nil), skey.Curve.Pkey...)
+	}
+	pkey.Ed.Pkey = append([]byte(nil), skey.Ed.Pkey...)
+	return pkey
 }
 
+// GetCurveKey and GetEdKey return copies of the secret halves in ordinary
+// memory, which neither Wipe nor the finalizer of the key reach. The caller
+// must zero them once done.
 func (skey Skey) GetCurveKey() *[32]byte {
 	curveSkey := *skey.curveSkey
 	return &curveSkey
@@ -106,28 +245,234 @@ func (skey *Skey) Sign(message []byte) []byte {
 	return ed25519.Sign(skey.edSkey, message)[:]
 }
 
-func (skey *Skey) Encrypt(password []byte) {
-	skey.xor(password)
+// SignWithContext signs message with one of the RFC 8032 variants: pure
+// SigAlgEd25519 without context, SigAlgEd25519ctx with a non-empty context
+// or SigAlgEd25519ph with an optional one. For SigAlgEd25519ph message is
+// the SHA-512 digest of the content. A signature never verifies under
+// another variant or context.
+func (skey *Skey) SignWithContext(message []byte, alg string, context string) ([]byte, error) {
+	if skey.edSkey == nil {
+		return nil, errors.New("Key is locked")
+	}
+	opts, err := ed25519Options(alg, context)
+	if err != nil {
+		return nil, err
+	}
+	return stded25519.PrivateKey(skey.edSkey[:]).Sign(nil, message, opts)
+}
+
+func ed25519Options(alg string, context string) (*stded25519.Options, error) {
+	opts := &stded25519.Options{Context: context}
+	switch alg {
+	case SigAlgEd25519:
+		if context != "" {
+			return nil, errors.New("Pure ed25519 has no context")
+		}
+	case SigAlgEd25519ctx:
+		if context == "" {
+			return nil, errors.New("Ed25519ctx needs a context")
+		}
+	case SigAlgEd25519ph:
+		opts.Hash = crypto.SHA512
+	default:
+		return nil, errors.New("Unsupported signature algorithm")
+	}
+	if len(context) > 255 {
+		return nil, errors.New("Signature context too long")
+	}
+	return opts, nil
+}
+
+// Encrypt seals the secret halves of the key with XChaCha20-Poly1305 under a
+// password derived key. Everything else stays in clear text and is bound to
+// the box as additional data, so it can't be swapped without notice.
+func (skey *Skey) Encrypt(password []byte) error {
+	if skey.curveSkey == nil || skey.edSkey == nil {
+		return errors.New("Key is locked")
+	}
+	key, err := skey.Kdf.Key(password, chacha20poly1305.KeySize)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	plaintext := make([]byte, 0, len(skey.curveSkey)+len(skey.edSkey))
+	plaintext = append(plaintext, skey.curveSkey[:]...)
+	plaintext = append(plaintext, skey.edSkey[:]...)
+	defer secmem.Wipe(plaintext)
+	defer secmem.Wipe(key)
+
+	skey.Version = SkeyVersion
+	skey.Curve.Skey = nil
+	skey.Ed.Skey = nil
+	skey.Checksum = nil
+	skey.Nonce = nonce
+	skey.Box = aead.Seal(nil, nonce, plaintext, skey.additionalData())
+	return nil
 }
 
+// Decrypt unlocks the key. Keys written before SkeyVersion 2 are still
+// accepted; encrypting them again converts them to the current format.
 func (skey *Skey) Decrypt(password []byte) error {
-	skey.xor(password)
+	switch {
+	case skey.Version > SkeyVersion:
+		return errors.New("Unsupported key version")
+	case skey.Version < SkeyVersion:
+		// The keystream is applied to a copy, a wrong password must not
+		// garble the key.
+		c := skey.clone()
+		err := c.xor(password)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(c.Checksum, c.checksum()) {
+			secmem.Wipe(c.Curve.Skey)
+			secmem.Wipe(c.Ed.Skey)
+			return errors.New("Bad checksum")
+		}
+		skey.ID, skey.Curve.Pkey, skey.Ed.Pkey = c.ID, c.Curve.Pkey, c.Ed.Pkey
+		skey.Curve.Skey, skey.Ed.Skey, skey.Checksum = c.Curve.Skey, c.Ed.Skey, c.Checksum
+	case skey.Box != nil:
+		return skey.open(password)
+	}
+	if !bytes.Equal(skey.Checksum, skey.checksum()) {
+		return errors.New("Bad checksum")
+	}
+	skey.unpack(skey.Curve.Skey, skey.Ed.Skey)
+
+	// Keep the secret halves only in the memory of skey.
+	secmem.Wipe(skey.Curve.Skey)
+	secmem.Wipe(skey.Ed.Skey)
+	skey.Curve.Skey, skey.Ed.Skey, skey.Checksum = nil, nil, nil
+	return nil
+}
+
+// ChangePassword unlocks skey with oldPassword and seals it again with
+// newPassword under kdf, or under the kdf of the key with a fresh salt if kdf
+// is nil. A nil newPassword strips the protection, such a key is stored with
+// MarshalUnencrypted. An unlocked key that was never sealed needs no
+// oldPassword. Nothing is changed if it fails, on success skey is left
+// unlocked.
+func (skey *Skey) ChangePassword(oldPassword, newPassword []byte, kdf *Kdf) error {
+	var err error
+	c := skey.clone()
+	if skey.Box == nil && skey.unlocked() {
+		c.setSecret(skey.GetCurveKey(), skey.GetEdKey())
+	} else {
+		err = c.Decrypt(oldPassword)
+		if err != nil {
+			return err
+		}
+	}
+	if kdf == nil {
+		kdf = &Kdf{}
+		*kdf = skey.Kdf
+		kdf.Salt = make([]byte, 32)
+		_, err = rand.Read(kdf.Salt)
+		if err != nil {
+			c.Wipe()
+			return err
+		}
+	}
+	c.Kdf = *kdf
+	c.Version = SkeyVersion
+	c.Nonce, c.Box = nil, nil
+	if newPassword != nil {
+		// Derive once to reject bad parameters before anything is changed.
+		err = c.Encrypt(newPassword)
+		if err != nil {
+			c.Wipe()
+			return err
+		}
+	}
+	skey.Wipe()
+	*skey = *c
+	return nil
+}
+
+// clone returns a locked copy of skey sharing no memory with it, since
+// decrypting an old format key changes its fields in place.
+func (skey *Skey) clone() *Skey {
+	c := *skey
+	c.curveSkey, c.edSkey, c.mem = nil, nil, nil
+	c.ID = append([]byte(nil), skey.ID...)
+	c.Kdf.Salt = append([]byte(nil), skey.Kdf.Salt...)
+	c.Curve.Pkey = append([]byte(nil), skey.Curve.Pkey...)
+	c.Curve.Skey = append([]byte(nil), skey.Curve.Skey...)
+	c.Ed.Pkey = append([]byte(nil), skey.Ed.Pkey...)
+	c.Ed.Skey = append([]byte(nil), skey.Ed.Skey...)
+	c.Checksum = append([]byte(nil), skey.Checksum...)
+	c.Nonce = append([]byte(nil), skey.Nonce...)
+	c.Box = append([]byte(nil), skey.Box...)
+	c.Meta = skey.Meta.clone()
+	c.pkey = skey.pkey.clone()
+	return &c
+}
+
+func (skey *Skey) open(password []byte) error {
+	key, err := skey.Kdf.Key(password, chacha20poly1305.KeySize)
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	if len(skey.Nonce) != aead.NonceSize() {
+		return errors.New("Bad nonce size")
+	}
+	plaintext, err := aead.Open(nil, skey.Nonce, skey.Box, skey.additionalData())
+	if err != nil {
+		return errors.New("Decryption failed")
+	}
+	defer secmem.Wipe(plaintext)
+	if len(plaintext) != 32+64 {
+		return errors.New("Bad secret key size")
+	}
+	skey.unpack(plaintext[:32], plaintext[32:])
+	return nil
+}
+
+func (skey *Skey) unpack(curveSkey, edSkey []byte) {
 	curvePkey := &[32]byte{}
 	edPkey := &[32]byte{}
 	copy(curvePkey[:], skey.Curve.Pkey)
 	copy(edPkey[:], skey.Ed.Pkey)
-	skey.pkey = NewPkey(curvePkey, edPkey)
+	if skey.Alg == AlgEd25519 {
+		skey.pkey = NewEdPkey(edPkey)
+	} else {
+		skey.pkey = NewPkey(curvePkey, edPkey)
+	}
 	skey.pkey.ID = skey.ID
+	skey.pkey.Meta = skey.Meta
 
-	skey.curveSkey = &[32]byte{}
-	skey.edSkey = &[64]byte{}
-	copy(skey.curveSkey[:], skey.Curve.Skey)
-	copy(skey.edSkey[:], skey.Ed.Skey)
+	curve, ed := &[32]byte{}, &[64]byte{}
+	copy(curve[:], curveSkey)
+	copy(ed[:], edSkey)
+	skey.setSecret(curve, ed)
+}
 
-	if !bytes.Equal(skey.Checksum, skey.checksum()) {
-		return errors.New("Bad checksum")
+// additionalData encodes every clear text field of the key file as
+// length prefixed values in a fixed order.
+func (skey *Skey) additionalData() []byte {
+	var ad bytes.Buffer
+	binary.Write(&ad, binary.BigEndian, uint32(skey.Version))
+	for _, v := range [][]byte{[]byte(skey.Alg), skey.ID, []byte(skey.Kdf.Alg), skey.Kdf.Salt, skey.Curve.Pkey, skey.Ed.Pkey} {
+		binary.Write(&ad, binary.BigEndian, uint32(len(v)))
+		ad.Write(v)
 	}
-	return nil
+	for _, v := range []int{skey.Kdf.Rounds, skey.Kdf.Memory, skey.Kdf.BlockSize, skey.Kdf.Parallelism} {
+		binary.Write(&ad, binary.BigEndian, uint64(v))
+	}
+	return ad.Bytes()
 }
 
 func (skey *Skey) checksum() []byte {
@@ -138,10 +483,15 @@ func (skey *Skey) checksum() []byte {
 	return checksum.Sum([]byte{})
 }
 
-func (skey *Skey) xor(password []byte) {
+// xor is the keystream scheme used by keys older than SkeyVersion 2.
+// It is kept only to read such keys.
+func (skey *Skey) xor(password []byte) error {
 	s := skey
 	l := len(s.ID) + len(s.Ed.Pkey) + len(s.Ed.Skey) + len(s.Curve.Pkey) + len(s.Curve.Skey) + len(s.Checksum)
-	dk := pbkdf2.Key(password, s.Kdf.Salt, s.Kdf.Rounds, l, blake2b.New512)
+	dk, err := s.Kdf.Key(password, l)
+	if err != nil {
+		return err
+	}
 	v := [][]byte{s.ID, s.Curve.Pkey, s.Curve.Skey, s.Ed.Pkey, s.Ed.Skey, s.Checksum}
 	j := 0
 	for k := range v {
@@ -150,73 +500,241 @@ func (skey *Skey) xor(password []byte) {
 			j++
 		}
 	}
+	return nil
 }
 
 func GenerateKey() (*Skey, error) {
-	curvePkey, curveSkey, err := box.GenerateKey(rand.Reader)
+	kdf, err := NewKdf(KdfPbkdf2Blake2b)
 	if err != nil {
 		return nil, err
 	}
-	edPkey, edSkey, err := ed25519.GenerateKey(rand.Reader)
+	return GenerateKeyWithKdf(kdf)
+}
+
+func GenerateKeyWithKdf(kdf *Kdf) (*Skey, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
 	if err != nil {
 		return nil, err
 	}
-	pkey := NewPkey(curvePkey, edPkey)
-	skey := Skey{pkey: pkey, curveSkey: curveSkey, edSkey: edSkey}
-	salt := make([]byte, 32)
-	_, err = rand.Read(salt)
+	return generateKey(rand.Reader, rand.Reader, id, kdf)
+}
+
+// GenerateEdKey generates an AlgEd25519 key.
+func GenerateEdKey(kdf *Kdf) (*Skey, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
 	if err != nil {
 		return nil, err
 	}
-	rounds := 4096
-	id := make([]byte, 8)
-	_, err = rand.Read(id)
+	return generateEdKey(rand.Reader, id, kdf)
+}
+
+func generateKey(curveRand, edRand io.Reader, id []byte, kdf *Kdf) (*Skey, error) {
+	curvePkey, curveSkey, err := box.GenerateKey(curveRand)
+	if err != nil {
+		return nil, err
+	}
+	edPkey, edSkey, err := ed25519.GenerateKey(edRand)
 	if err != nil {
 		return nil, err
 	}
+	return newSkey(NewPkey(curvePkey, edPkey), curveSkey, edSkey, id, kdf), nil
+}
+
+func generateEdKey(edRand io.Reader, id []byte, kdf *Kdf) (*Skey, error) {
+	edPkey, edSkey, err := ed25519.GenerateKey(edRand)
+	if err != nil {
+		return nil, err
+	}
+	return newSkey(NewEdPkey(edPkey), EdSkeyToCurve(edSkey), edSkey, id, kdf), nil
+}
+
+// importEdPkey and importEdSkey make AlgEd25519 keys out of Ed25519 keys
+// of other tools.
+func importEdPkey(edPkey []byte, id []byte) *Pkey {
+	key := &[32]byte{}
+	copy(key[:], edPkey)
+	pkey := NewEdPkey(key)
+	pkey.ID = append([]byte{}, id...)
+	return pkey
+}
+
+func importEdSkey(edSkey []byte, id []byte) (*Skey, error) {
+	if len(edSkey) != 64 || !bytes.Equal(stded25519.NewKeyFromSeed(edSkey[:32]), edSkey) {
+		return nil, errors.New("Bad ed25519 secret key")
+	}
+	kdf, err := NewKdf(KdfPbkdf2Blake2b)
+	if err != nil {
+		return nil, err
+	}
+	key := &[64]byte{}
+	copy(key[:], edSkey)
+	pkey := importEdPkey(edSkey[32:], id)
+	return newSkey(pkey, EdSkeyToCurve(key), key, pkey.ID, kdf), nil
+}
+
+// newSkey takes over the secret halves, they are wiped after being copied
+// into the key.
+func newSkey(pkey *Pkey, curveSkey *[32]byte, edSkey *[64]byte, id []byte, kdf *Kdf) *Skey {
+	skey := Skey{pkey: pkey}
+	skey.setSecret(curveSkey, edSkey)
+	skey.Version = SkeyVersion
 	skey.Alg = pkey.Alg
 	pkey.ID = id
 	skey.ID = pkey.ID
-	skey.Kdf.Alg = "pbkdf2-blake2b"
-	skey.Kdf.Rounds = rounds
-	skey.Kdf.Salt = salt
-
-	skey.Curve.Pkey = pkey.Curve.Pkey
-	skey.Curve.Skey = curveSkey[:]
+	skey.Kdf = *kdf
 
+	skey.Curve.Pkey = pkey.GetCurveKey()[:]
 	skey.Ed.Pkey = pkey.Ed.Pkey
-	skey.Ed.Skey = edSkey[:]
 
-	skey.Checksum = skey.checksum()
+	skey.SetMeta(KeyMeta{})
+	return &skey
+}
 
-	return &skey, nil
+// SignatureMeta is optional metadata of a Signature, signed together with
+// the signature itself by MetaSig, like the trusted comment of minisign.
+// Timestamp is in Unix seconds.
+type SignatureMeta struct {
+	Comment   string `json:"comment,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	File      string `json:"file,omitempty"`
+	Purpose   string `json:"purpose,omitempty"`
 }
 
+// Signature is a signature of a hash of some content: blake2b-512 signed
+// with SigAlgEd25519ctx, or SHA-512 signed with SigAlgEd25519ph. Context
+// separates signatures made for different purposes, it is ContextFile
+// unless the application picks its own. Meta is covered by MetaSig, signed
+// for ContextMeta, UntrustedComment is not signed at all.
 type Signature struct {
-	Alg  string `json:"alg"`
-	Pkey *Pkey  `json:"pkey"`
-	Hash []byte `json:"hash"`
-	Sig  []byte `json:"sig"`
+	Alg              string         `json:"alg"`
+	Context          string         `json:"context,omitempty"`
+	Pkey             *Pkey          `json:"pkey"`
+	Hash             []byte         `json:"hash"`
+	Sig              []byte         `json:"sig"`
+	Meta             *SignatureMeta `json:"meta,omitempty"`
+	MetaSig          []byte         `json:"metasig,omitempty"`
+	UntrustedComment string         `json:"untrustedcomment,omitempty"`
+}
+
+// UnmarshalJSON marks the key of the signature as embedded, it is not
+// trusted to be complete.
+func (sig *Signature) UnmarshalJSON(data []byte) error {
+	type plainSignature Signature
+	err := json.Unmarshal(data, (*plainSignature)(sig))
+	if err == nil && sig.Pkey != nil {
+		sig.Pkey.embedded = true
+	}
+	return err
 }
 
+// NewSignature makes a file signature, of SigAlgEd25519ctx for
+// ContextFile.
 func NewSignature(pkey *Pkey) *Signature {
 	sig := &Signature{}
-	sig.Alg = "ed25519"
+	sig.Alg = SigAlgEd25519ctx
+	sig.Context = ContextFile
 	sig.Pkey = pkey
 	return sig
 }
 
+// NewContextSignature makes a signature of alg SigAlgEd25519ctx or
+// SigAlgEd25519ph for context, ContextFile if it is empty.
+func NewContextSignature(pkey *Pkey, alg string, context string) *Signature {
+	sig := NewSignature(pkey)
+	sig.Alg = alg
+	if context != "" {
+		sig.Context = context
+	}
+	return sig
+}
+
+// Sign signs the content of r, and Meta if set. A zero Meta.Timestamp is
+// set to the current time. A locked skey is used through the agent named by
+// AgentSockEnv.
 func (sig *Signature) Sign(skey *Skey, r io.Reader) error {
 	hash, err := sig.computeHash(r)
 	if err != nil {
 		return err
 	}
-	sig.Hash = hash
-	sig.Sig = skey.Sign(sig.Hash)
-	return nil
+	return sig.signHash(skey, hash)
+}
+
+func (sig *Signature) signHash(skey *Skey, hash []byte) error {
+	if sig.Alg == SigAlgEd25519 {
+		return errors.New("Signatures need ed25519ctx or ed25519ph")
+	}
+	s, err := signWith(skey, hash, sig.Alg, sig.Context)
+	if err != nil {
+		return err
+	}
+	sig.Hash, sig.Sig, sig.MetaSig = hash, s, nil
+	if sig.Meta == nil {
+		return nil
+	}
+	if sig.Meta.Timestamp == 0 {
+		sig.Meta.Timestamp = time.Now().Unix()
+	}
+	sig.MetaSig, err = signWith(skey, sig.metaData(), SigAlgEd25519ctx, ContextMeta)
+	return err
+}
+
+// signWith signs message with skey, or through the agent if skey is locked.
+func signWith(skey *Skey, message []byte, alg string, context string) ([]byte, error) {
+	if skey.edSkey != nil {
+		return skey.SignWithContext(message, alg, context)
+	}
+	opts, err := ed25519Options(alg, context)
+	if err != nil {
+		return nil, err
+	}
+	s, err := agentSign(skey, message, alg, context)
+	if err != nil {
+		return nil, err
+	}
+	if len(skey.Ed.Pkey) != stded25519.PublicKeySize || stded25519.VerifyWithOptions(skey.Ed.Pkey, message, s, opts) != nil {
+		return nil, errors.New("Agent signed with another key")
+	}
+	return s, nil
+}
+
+// Verify verifies the file signature of the content of r and returns its
+// verified metadata, nil if it has none.
+func (sig *Signature) Verify(r io.Reader) (*SignatureMeta, error) {
+	return sig.VerifyContext(r, ContextFile)
+}
+
+// VerifyContext is Verify for signatures made for context. It fails with
+// ErrSignatureContext for signatures of another context and with
+// ErrLegacySignature for pure ed25519 signatures of older versions.
+func (sig *Signature) VerifyContext(r io.Reader, context string) (*SignatureMeta, error) {
+	if sig.Alg == SigAlgEd25519 {
+		return nil, ErrLegacySignature
+	}
+	if sig.Alg != SigAlgEd25519ctx && sig.Alg != SigAlgEd25519ph {
+		return nil, errors.New("Unsupported signature algorithm")
+	}
+	if sig.Context != context {
+		return nil, ErrSignatureContext
+	}
+	hash, err := sig.computeHash(r)
+	if err != nil {
+		return nil, err
+	}
+	return sig.verifyHash(hash, context)
 }
 
-func (sig *Signature) Verify(r io.Reader) error {
+// VerifyLegacy verifies a pure ed25519 signature of older versions, which
+// has no context and no metadata. Such a signature may as well be made for
+// another protocol, so it is only accepted when the caller opts in.
+func (sig *Signature) VerifyLegacy(r io.Reader) error {
+	if sig.Alg != SigAlgEd25519 || sig.Context != "" || sig.Meta != nil || sig.MetaSig != nil {
+		return errors.New("Not a legacy signature")
+	}
+	if sig.Pkey == nil {
+		return errors.New("Signature has no public key")
+	}
 	hash, err := sig.computeHash(r)
 	if err != nil {
 		return err
@@ -227,11 +745,57 @@ func (sig *Signature) Verify(r io.Reader) error {
 	return sig.Pkey.Verify(sig.Hash, sig.Sig)
 }
 
+// verifyHash checks the signature with the context the caller expects, the
+// context of sig is not trusted.
+func (sig *Signature) verifyHash(hash []byte, context string) (*SignatureMeta, error) {
+	if sig.Pkey == nil {
+		return nil, errors.New("Signature has no public key")
+	}
+	if !bytes.Equal(sig.Hash, hash) {
+		return nil, errors.New("Bad checksum")
+	}
+	if sig.Alg != SigAlgEd25519ctx && sig.Alg != SigAlgEd25519ph {
+		return nil, errors.New("Unsupported signature algorithm")
+	}
+	err := sig.Pkey.VerifyWithContext(sig.Hash, sig.Sig, sig.Alg, context)
+	if err != nil {
+		return nil, err
+	}
+	if sig.Meta == nil && sig.MetaSig == nil {
+		return nil, nil
+	}
+	if sig.Meta == nil {
+		return nil, errors.New("Signature metadata is missing")
+	}
+	err = sig.Pkey.verifyContext(sig.metaData(), sig.MetaSig, ContextMeta)
+	if err != nil {
+		return nil, errors.New("Bad signature metadata")
+	}
+	meta := *sig.Meta
+	return &meta, nil
+}
+
+// metaData binds Meta to the signature of the content.
+func (sig *Signature) metaData() []byte {
+	var data bytes.Buffer
+	writeFields(&data, [][]byte{[]byte("cryptostack signature meta"), []byte(sig.Alg), sig.Sig,
+		[]byte(sig.Meta.Comment), []byte(sig.Meta.File), []byte(sig.Meta.Purpose)})
+	binary.Write(&data, binary.BigEndian, sig.Meta.Timestamp)
+	return data.Bytes()
+}
+
 func (sig *Signature) computeHash(r io.Reader) ([]byte, error) {
-	hash := blake2b.New512()
+	hash := sig.newHash()
 	_, err := io.Copy(hash, r)
 	if err != nil {
 		return nil, err
 	}
 	return hash.Sum([]byte{}), nil
 }
+
+func (sig *Signature) newHash() hash.Hash {
+	if sig.Alg == SigAlgEd25519ph {
+		return sha512.New()
+	}
+	return blake2b.New512()
+}
@@ -0,0 +1,118 @@
+package cryptostack
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/ArtemKulyabin/cryptostack/internal/secmem"
+)
+
+// LockMemory makes keys unlocked afterwards keep their secret halves in
+// memory locked with mlock, so they are never written to swap. Where locking
+// is not available the keys silently use ordinary memory.
+var LockMemory = false
+
+// ErrUnencrypted is returned by MarshalJSON for a secret key that is not
+// sealed with a password.
+var ErrUnencrypted = errors.New("Secret key is not encrypted")
+
+// secret holds the secret halves of an unlocked key. Copies of the Skey
+// share it, a finalizer wipes and frees it once none of them is left.
+type secret struct {
+	b      []byte
+	locked bool
+}
+
+func (s *secret) free() {
+	secmem.Free(s.b, s.locked)
+	s.locked = false
+}
+
+// setSecret copies the secret halves into memory owned by skey, locked if
+// LockMemory is set, and wipes the given ones.
+func (skey *Skey) setSecret(curveSkey *[32]byte, edSkey *[64]byte) {
+	skey.Wipe()
+	skey.mem = &secret{}
+	if LockMemory {
+		skey.mem.b, skey.mem.locked = secmem.Alloc(32 + 64)
+	} else {
+		skey.mem.b = make([]byte, 32+64)
+	}
+	runtime.SetFinalizer(skey.mem, (*secret).free)
+	skey.curveSkey = (*[32]byte)(skey.mem.b[:32])
+	skey.edSkey = (*[64]byte)(skey.mem.b[32:])
+	*skey.curveSkey = *curveSkey
+	*skey.edSkey = *edSkey
+	secmem.Wipe(curveSkey[:])
+	secmem.Wipe(edSkey[:])
+}
+
+// Wipe zeroes the secret halves of an unlocked key and locks it. A key
+// sealed by Encrypt or read from an encrypted file can be decrypted again.
+func (skey *Skey) Wipe() {
+	if skey.mem != nil {
+		skey.mem.free()
+		runtime.SetFinalizer(skey.mem, nil)
+	} else {
+		if skey.curveSkey != nil {
+			secmem.Wipe(skey.curveSkey[:])
+		}
+		if skey.edSkey != nil {
+			secmem.Wipe(skey.edSkey[:])
+		}
+	}
+	skey.mem = nil
+	skey.curveSkey, skey.edSkey = nil, nil
+}
+
+// unlocked reports whether the secret halves are in memory.
+func (skey *Skey) unlocked() bool {
+	return skey.curveSkey != nil && skey.edSkey != nil
+}
+
+// String never shows secret material, so keys can be logged safely.
+func (skey Skey) String() string {
+	state := "locked"
+	if skey.unlocked() {
+		state = "unlocked"
+	}
+	return fmt.Sprintf("Skey(%s %s %s)", skey.Alg, hex.EncodeToString(skey.ID), state)
+}
+
+// Format prints String for every verb, %#v and %x included.
+func (skey Skey) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, skey.String())
+}
+
+// MarshalJSON fails with ErrUnencrypted if the secret halves would be
+// written in clear text, i.e. the key is unlocked or was read unencrypted
+// and has not been sealed by Encrypt. Use MarshalUnencrypted to store such
+// a key on purpose.
+func (skey Skey) MarshalJSON() ([]byte, error) {
+	type plainSkey Skey
+	if skey.Box == nil && (skey.unlocked() || (skey.Version >= SkeyVersion && (skey.Curve.Skey != nil || skey.Ed.Skey != nil))) {
+		return nil, ErrUnencrypted
+	}
+	return json.Marshal(plainSkey(skey))
+}
+
+// MarshalUnencrypted encodes an unlocked key with its secret halves in
+// clear text, Decrypt reads it with any password.
+func (skey *Skey) MarshalUnencrypted() ([]byte, error) {
+	type plainSkey Skey
+	if !skey.unlocked() {
+		return nil, errors.New("Key is locked")
+	}
+	c := *skey
+	c.Version = SkeyVersion
+	c.Nonce, c.Box = nil, nil
+	c.Curve.Skey = append([]byte{}, skey.curveSkey[:]...)
+	c.Ed.Skey = append([]byte{}, skey.edSkey[:]...)
+	defer secmem.Wipe(c.Curve.Skey)
+	defer secmem.Wipe(c.Ed.Skey)
+	c.Checksum = c.checksum()
+	return json.Marshal(plainSkey(c))
+}
@@ -0,0 +1,102 @@
+package cryptostack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// TimeFunc provides the current time to check key expiry against.
+var TimeFunc = time.Now
+
+// KeyMeta is metadata of a key signed by the key itself. Times are unix
+// seconds, zero Expires means the key never expires and empty Usages
+// means any usage is allowed.
+type KeyMeta struct {
+	Created int64    `json:"created"`
+	Expires int64    `json:"expires,omitempty"`
+	Comment string   `json:"comment,omitempty"`
+	Usages  []string `json:"usages,omitempty"`
+	Sig     []byte   `json:"sig"`
+}
+
+func (meta *KeyMeta) clone() *KeyMeta {
+	if meta == nil {
+		return nil
+	}
+	c := *meta
+	c.Usages = append([]string(nil), meta.Usages...)
+	c.Sig = append([]byte(nil), meta.Sig...)
+	return &c
+}
+
+// SetMeta signs meta and attaches it to the key and its public key.
+func (skey *Skey) SetMeta(meta KeyMeta) error {
+	if skey.edSkey == nil || skey.pkey == nil {
+		return errors.New("Key is locked")
+	}
+	for _, u := range meta.Usages {
+		if u != UsageSign && u != UsageEncrypt && u != UsageCertify {
+			return errors.New("Unknown key usage")
+		}
+	}
+	if meta.Created == 0 {
+		meta.Created = TimeFunc().Unix()
+	}
+	sig, err := skey.SignWithContext(meta.signedData(skey.pkey), SigAlgEd25519ctx, ContextKeyMeta)
+	if err != nil {
+		return err
+	}
+	meta.Sig = sig
+	skey.Meta = &meta
+	skey.pkey.Meta = &meta
+	return nil
+}
+
+// CheckUsage returns ErrKeyExpired or ErrKeyUsage if pkey must not be used
+// for usage now. Keys without metadata are good for anything, except a key
+// embedded in a Signature, whose metadata may have been stripped; it fails
+// with ErrKeyMetaMissing.
+func (pkey *Pkey) CheckUsage(usage string) error {
+	return pkey.checkMeta(usage, TimeFunc())
+}
+
+func (pkey *Pkey) checkMeta(usage string, t time.Time) error {
+	meta := pkey.Meta
+	if meta == nil {
+		if pkey.embedded {
+			return ErrKeyMetaMissing
+		}
+		return nil
+	}
+	if pkey.verifyContext(meta.signedData(pkey), meta.Sig, ContextKeyMeta) != nil {
+		return errors.New("Bad key metadata signature")
+	}
+	if meta.Expires != 0 && t.Unix() > meta.Expires {
+		return ErrKeyExpired
+	}
+	if len(meta.Usages) == 0 {
+		return nil
+	}
+	for _, u := range meta.Usages {
+		if u == usage {
+			return nil
+		}
+	}
+	return ErrKeyUsage
+}
+
+func (meta *KeyMeta) signedData(pkey *Pkey) []byte {
+	var data bytes.Buffer
+	fields := [][]byte{[]byte("cryptostack key meta"), []byte(meta.Comment)}
+	fields = append(fields, pkeyFields(pkey)...)
+	for _, u := range meta.Usages {
+		fields = append(fields, []byte(u))
+	}
+	binary.Write(&data, binary.BigEndian, uint32(len(meta.Usages)))
+	writeFields(&data, fields)
+	binary.Write(&data, binary.BigEndian, meta.Created)
+	binary.Write(&data, binary.BigEndian, meta.Expires)
+	return data.Bytes()
+}
@@ -0,0 +1,307 @@
+package cryptostack
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	minisignAlg       = "Ed"
+	minisignHashedAlg = "ED"
+	minisignKdfAlg    = "Sc"
+	minisignChkAlg    = "B2"
+
+	// libsodium's OPSLIMIT_SENSITIVE and MEMLIMIT_SENSITIVE, as used by
+	// minisign itself.
+	minisignOpsLimit = 1 << 25
+	minisignMemLimit = 1 << 30
+
+	untrustedCommentPrefix = "untrusted comment: "
+	trustedCommentPrefix   = "trusted comment: "
+)
+
+// MarshalMinisign encodes the Ed25519 half of pkey as a minisign public
+// key file. Pkey.ID is used as the minisign key ID.
+func (pkey *Pkey) MarshalMinisign() ([]byte, error) {
+	if len(pkey.ID) != 8 {
+		return nil, errors.New("Key ID must be 8 bytes")
+	}
+	raw := append([]byte(minisignAlg), pkey.ID...)
+	raw = append(raw, pkey.GetEdKey()[:]...)
+	return encodeTextKey("minisign public key "+minisignKeyID(pkey.ID), raw), nil
+}
+
+// ParseMinisignPkey decodes a minisign public key file or a bare base64
+// public key. The result is an AlgEd25519 key.
+func ParseMinisignPkey(data []byte) (*Pkey, error) {
+	_, raw, err := decodeTextKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 2+8+32 || string(raw[:2]) != minisignAlg {
+		return nil, errors.New("Bad minisign public key")
+	}
+	return importEdPkey(raw[10:], raw[2:10]), nil
+}
+
+// MarshalMinisign encodes the Ed25519 half of skey as a minisign secret
+// key file encrypted with password, or unencrypted if password is empty.
+func (skey *Skey) MarshalMinisign(password []byte) ([]byte, error) {
+	return skey.marshalMinisign(password, minisignOpsLimit, minisignMemLimit)
+}
+
+func (skey *Skey) marshalMinisign(password []byte, opsLimit, memLimit uint64) ([]byte, error) {
+	if skey.edSkey == nil {
+		return nil, errors.New("Key is locked")
+	}
+	if len(skey.ID) != 8 {
+		return nil, errors.New("Key ID must be 8 bytes")
+	}
+	raw := make([]byte, 2+2+2+32+8+8, 2+2+2+32+8+8+104)
+	copy(raw, minisignAlg)
+	copy(raw[4:], minisignChkAlg)
+	if len(password) > 0 {
+		copy(raw[2:], minisignKdfAlg)
+		_, err := rand.Read(raw[6:38])
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(raw[38:], opsLimit)
+		binary.LittleEndian.PutUint64(raw[46:], memLimit)
+	}
+	raw = append(raw, skey.ID...)
+	raw = append(raw, skey.edSkey[:]...)
+	raw = append(raw, minisignChecksum(raw[54:54+8], raw[62:62+64])...)
+	if len(password) > 0 {
+		err := minisignXor(raw[54:], password, raw[6:38], opsLimit, memLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	comment := "minisign encrypted secret key"
+	if len(password) == 0 {
+		comment = "minisign secret key"
+	}
+	return encodeTextKey(comment, raw), nil
+}
+
+func ParseMinisignSkey(data []byte, password []byte) (*Skey, error) {
+	_, raw, err := decodeTextKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 2+2+2+32+8+8+104 || string(raw[:2]) != minisignAlg || string(raw[4:6]) != minisignChkAlg {
+		return nil, errors.New("Bad minisign secret key")
+	}
+	switch string(raw[2:4]) {
+	case minisignKdfAlg:
+		opsLimit := binary.LittleEndian.Uint64(raw[38:])
+		memLimit := binary.LittleEndian.Uint64(raw[46:])
+		if opsLimit > minisignOpsLimit || memLimit > minisignMemLimit {
+			return nil, errors.New("Bad kdf parameters")
+		}
+		err = minisignXor(raw[54:], password, raw[6:38], opsLimit, memLimit)
+		if err != nil {
+			return nil, err
+		}
+	case "\x00\x00":
+	default:
+		return nil, errors.New("Unsupported minisign kdf")
+	}
+	id, edSkey, chk := raw[54:62], raw[62:126], raw[126:]
+	if subtle.ConstantTimeCompare(chk, minisignChecksum(id, edSkey)) != 1 {
+		return nil, errors.New("Wrong password for minisign secret key")
+	}
+	return importEdSkey(edSkey, id)
+}
+
+func minisignChecksum(id, edSkey []byte) []byte {
+	hash := blake2b.New256()
+	hash.Write([]byte(minisignAlg))
+	hash.Write(id)
+	hash.Write(edSkey)
+	return hash.Sum([]byte{})
+}
+
+func minisignXor(data, password, salt []byte, opsLimit, memLimit uint64) error {
+	n, r, p := minisignScryptParams(opsLimit, memLimit)
+	stream, err := scrypt.Key(password, salt, n, r, p, len(data))
+	if err != nil {
+		return err
+	}
+	for i := range data {
+		data[i] ^= stream[i]
+	}
+	return nil
+}
+
+// minisignScryptParams is libsodium's pickparams for
+// crypto_pwhash_scryptsalsa208sha256.
+func minisignScryptParams(opsLimit, memLimit uint64) (n, r, p int) {
+	if opsLimit < 32768 {
+		opsLimit = 32768
+	}
+	r = 8
+	var maxN uint64
+	if opsLimit < memLimit/32 {
+		p = 1
+		maxN = opsLimit / uint64(r*4)
+	} else {
+		maxN = memLimit / uint64(r*128)
+	}
+	logN := uint(1)
+	for ; logN < 63; logN++ {
+		if uint64(1)<<logN > maxN/2 {
+			break
+		}
+	}
+	if opsLimit >= memLimit/32 {
+		maxRP := (opsLimit / 4) / (uint64(1) << logN)
+		if maxRP > 0x3fffffff {
+			maxRP = 0x3fffffff
+		}
+		p = int(maxRP) / r
+	}
+	return 1 << logN, r, p
+}
+
+// MinisignSignature is a minisign signature file. The trusted comment is
+// covered by GlobalSig, the untrusted one is not.
+type MinisignSignature struct {
+	Alg              string
+	KeyID            []byte
+	Sig              []byte
+	UntrustedComment string
+	TrustedComment   string
+	GlobalSig        []byte
+}
+
+// SignMinisign signs the content of r. With prehash set the blake2b-512
+// digest of the content is signed, as minisign does by default since 0.8;
+// otherwise the content is read into memory.
+func SignMinisign(skey *Skey, r io.Reader, trustedComment string, prehash bool) (*MinisignSignature, error) {
+	if skey.edSkey == nil {
+		return nil, errors.New("Key is locked")
+	}
+	if strings.ContainsAny(trustedComment, "\r\n") {
+		return nil, errors.New("Comment must be a single line")
+	}
+	alg := minisignAlg
+	if prehash {
+		alg = minisignHashedAlg
+	}
+	message, err := minisignMessage(alg, r)
+	if err != nil {
+		return nil, err
+	}
+	sig := &MinisignSignature{
+		Alg:              alg,
+		KeyID:            skey.ID,
+		Sig:              skey.Sign(message),
+		UntrustedComment: "signature from cryptostack secret key",
+		TrustedComment:   trustedComment,
+	}
+	sig.GlobalSig = skey.Sign(append(append([]byte{}, sig.Sig...), trustedComment...))
+	return sig, nil
+}
+
+func (sig *MinisignSignature) Verify(pkey *Pkey, r io.Reader) error {
+	if !bytes.Equal(sig.KeyID, pkey.ID) {
+		return errors.New("Signature key ID doesn't match")
+	}
+	message, err := minisignMessage(sig.Alg, r)
+	if err != nil {
+		return err
+	}
+	err = pkey.Verify(message, sig.Sig)
+	if err != nil {
+		return err
+	}
+	return pkey.verify(append(append([]byte{}, sig.Sig...), sig.TrustedComment...), sig.GlobalSig)
+}
+
+func (sig *MinisignSignature) Marshal() []byte {
+	raw := append([]byte(sig.Alg), sig.KeyID...)
+	raw = append(raw, sig.Sig...)
+	var data bytes.Buffer
+	data.Write(encodeTextKey(sig.UntrustedComment, raw))
+	data.WriteString(trustedCommentPrefix + sig.TrustedComment + "\n")
+	data.WriteString(base64.StdEncoding.EncodeToString(sig.GlobalSig) + "\n")
+	return data.Bytes()
+}
+
+func ParseMinisignSignature(data []byte) (*MinisignSignature, error) {
+	lines := strings.Split(strings.TrimRight(string(data), "\r\n"), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], untrustedCommentPrefix) || !strings.HasPrefix(lines[2], trustedCommentPrefix) {
+		return nil, errors.New("Bad minisign signature")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 2+8+64 || (string(raw[:2]) != minisignAlg && string(raw[:2]) != minisignHashedAlg) {
+		return nil, errors.New("Bad minisign signature")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return nil, err
+	}
+	return &MinisignSignature{
+		Alg:              string(raw[:2]),
+		KeyID:            raw[2:10],
+		Sig:              raw[10:],
+		UntrustedComment: strings.TrimPrefix(strings.TrimRight(lines[0], "\r"), untrustedCommentPrefix),
+		TrustedComment:   strings.TrimPrefix(strings.TrimRight(lines[2], "\r"), trustedCommentPrefix),
+		GlobalSig:        globalSig,
+	}, nil
+}
+
+func minisignMessage(alg string, r io.Reader) ([]byte, error) {
+	if alg == minisignHashedAlg {
+		hash := blake2b.New512()
+		_, err := io.Copy(hash, r)
+		if err != nil {
+			return nil, err
+		}
+		return hash.Sum([]byte{}), nil
+	}
+	return ioutil.ReadAll(r)
+}
+
+func minisignKeyID(id []byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id))
+}
+
+// encodeTextKey and decodeTextKey handle the two line format shared by
+// minisign and signify: an untrusted comment followed by base64 data.
+func encodeTextKey(comment string, raw []byte) []byte {
+	return []byte(untrustedCommentPrefix + comment + "\n" + base64.StdEncoding.EncodeToString(raw) + "\n")
+}
+
+func decodeTextKey(data []byte) (string, []byte, error) {
+	lines := strings.Split(strings.TrimRight(string(data), "\r\n"), "\n")
+	comment := ""
+	if strings.HasPrefix(lines[0], untrustedCommentPrefix) {
+		comment = strings.TrimPrefix(strings.TrimRight(lines[0], "\r"), untrustedCommentPrefix)
+		lines = lines[1:]
+	}
+	if len(lines) != 1 {
+		return "", nil, errors.New("Bad key file")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return "", nil, err
+	}
+	return comment, raw, nil
+}
@@ -0,0 +1,141 @@
+package cryptostack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// MultiSignature collects signatures of several keys over one content
+// hash. Every entry is an ordinary Signature of the content, so a detached
+// signature of the same file can be added as is.
+type MultiSignature struct {
+	Alg        string       `json:"alg"`
+	Hash       []byte       `json:"hash"`
+	Signatures []*Signature `json:"signatures"`
+}
+
+// MultiSigPolicy says which keys are trusted to sign and how many distinct
+// ones of them must have signed.
+type MultiSigPolicy struct {
+	Threshold int
+	Keys      []*Pkey
+	// Keyring, if set, trusts its keys of marginal trust and above too.
+	Keyring *Keyring
+	// Revocations, if set, makes signatures of revoked or retired keys
+	// not count.
+	Revocations *Revocations
+}
+
+// NewMultiSignature hashes the content of r for signers to sign.
+func NewMultiSignature(r io.Reader) (*MultiSignature, error) {
+	hash, err := NewSignature(nil).computeHash(r)
+	if err != nil {
+		return nil, err
+	}
+	return &MultiSignature{Alg: SigAlgEd25519ctx, Hash: hash}, nil
+}
+
+// Sign adds a signature by skey with optional meta, replacing an earlier
+// one by the same key.
+func (ms *MultiSignature) Sign(skey *Skey, meta *SignatureMeta) error {
+	sig := NewSignature(skey.GetPkey())
+	sig.Meta = meta
+	err := sig.signHash(skey, ms.Hash)
+	if err != nil {
+		return err
+	}
+	return ms.Add(sig)
+}
+
+// Add adds sig, made by Signature.Sign of the same content, replacing an
+// earlier one by the same key. sig is checked against its own key only,
+// whether the key is trusted is up to Verify.
+func (ms *MultiSignature) Add(sig *Signature) error {
+	if sig.Alg != ms.Alg || sig.Context != ContextFile || !bytes.Equal(sig.Hash, ms.Hash) {
+		return errors.New("Signature is for other content")
+	}
+	if sig.Pkey == nil {
+		return errors.New("Signature has no public key")
+	}
+	_, err := sig.verifyHash(ms.Hash, ContextFile)
+	if err != nil {
+		return err
+	}
+	for i, other := range ms.Signatures {
+		if other.Pkey != nil && samePkey(other.Pkey, sig.Pkey) {
+			ms.Signatures[i] = sig
+			return nil
+		}
+	}
+	ms.Signatures = append(ms.Signatures, sig)
+	return nil
+}
+
+// Verify checks that the content of r has the signed hash and returns the
+// distinct trusted keys with a valid signature. It fails with
+// ErrNotEnoughSignatures, and still returns the keys, if they are fewer
+// than policy.Threshold.
+func (ms *MultiSignature) Verify(r io.Reader, policy *MultiSigPolicy) ([]*Pkey, error) {
+	if policy.Threshold < 1 {
+		return nil, errors.New("Bad signature threshold")
+	}
+	if ms.Alg != SigAlgEd25519ctx {
+		return nil, errors.New("Unknown multi-signature alg")
+	}
+	hash, err := NewSignature(nil).computeHash(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(ms.Hash, hash) {
+		return nil, errors.New("Bad checksum")
+	}
+
+	var signers []*Pkey
+	seen := map[string]bool{}
+	for _, sig := range ms.Signatures {
+		if sig.Pkey == nil || sig.Alg != ms.Alg || sig.Context != ContextFile {
+			continue
+		}
+		pkey := policy.trusted(sig.Pkey)
+		if pkey == nil {
+			continue
+		}
+		// Keys are told apart by the Ed25519 key, IDs are not signed.
+		key := string(pkey.GetEdKey()[:])
+		if seen[key] {
+			continue
+		}
+		if policy.Revocations != nil && policy.Revocations.Check(pkey) != nil {
+			continue
+		}
+		c := *sig
+		c.Pkey = pkey
+		_, err = c.verifyHash(hash, ContextFile)
+		if err != nil {
+			continue
+		}
+		seen[key] = true
+		signers = append(signers, pkey)
+	}
+	if len(signers) < policy.Threshold {
+		return signers, ErrNotEnoughSignatures
+	}
+	return signers, nil
+}
+
+// trusted returns the trusted copy of pkey, or nil.
+func (policy *MultiSigPolicy) trusted(pkey *Pkey) *Pkey {
+	for _, k := range policy.Keys {
+		if samePkey(k, pkey) {
+			return k
+		}
+	}
+	if policy.Keyring != nil {
+		k, err := policy.Keyring.Lookup(pkey.ID)
+		if err == nil && samePkey(k, pkey) {
+			return k
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package cryptostack
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sshSigMagic   = "SSHSIG"
+	sshSigVersion = 1
+	sshSigPEMType = "SSH SIGNATURE"
+)
+
+// OpenSSH and PKCS#8 keys don't carry a key ID, keys imported from them get
+// the first 8 bytes of the SHA-256 of the Ed25519 public key, so a public key
+// and its secret key imported separately still match.
+func importKeyID(edPkey []byte) []byte {
+	sum := sha256.Sum256(edPkey)
+	return sum[:8]
+}
+
+// MarshalAuthorizedKey encodes the Ed25519 half of pkey as an
+// authorized_keys line.
+func (pkey *Pkey) MarshalAuthorizedKey(comment string) ([]byte, error) {
+	sshPkey, err := ssh.NewPublicKey(ed25519.PublicKey(pkey.GetEdKey()[:]))
+	if err != nil {
+		return nil, err
+	}
+	line := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(sshPkey), []byte("\n"))
+	if comment != "" {
+		line = append(append(line, ' '), comment...)
+	}
+	return append(line, '\n'), nil
+}
+
+// ParseAuthorizedKey decodes the first ssh-ed25519 key of an authorized_keys
+// line and returns it as an AlgEd25519 key along with its comment.
+func ParseAuthorizedKey(data []byte) (*Pkey, string, error) {
+	sshPkey, comment, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, "", err
+	}
+	pkey, err := importSSHPkey(sshPkey)
+	return pkey, comment, err
+}
+
+func importSSHPkey(sshPkey ssh.PublicKey) (*Pkey, error) {
+	cryptoPkey, ok := sshPkey.(ssh.CryptoPublicKey)
+	if !ok || sshPkey.Type() != ssh.KeyAlgoED25519 {
+		return nil, errors.New("Not an ssh-ed25519 key")
+	}
+	edPkey, ok := cryptoPkey.CryptoPublicKey().(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("Not an ssh-ed25519 key")
+	}
+	return importEdPkey(edPkey, importKeyID(edPkey)), nil
+}
+
+// MarshalOpenSSH encodes the Ed25519 half of skey in the OpenSSH private key
+// format, encrypted with bcrypt-pbkdf and AES-256-CTR unless password is
+// empty.
+func (skey *Skey) MarshalOpenSSH(password []byte, comment string) ([]byte, error) {
+	if skey.edSkey == nil {
+		return nil, errors.New("Key is locked")
+	}
+	key := ed25519.PrivateKey(skey.edSkey[:])
+	var block *pem.Block
+	var err error
+	if len(password) > 0 {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, comment, password)
+	} else {
+		block, err = ssh.MarshalPrivateKey(key, comment)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// ParseOpenSSHSkey decodes an OpenSSH ed25519 private key. Password is
+// ignored for unencrypted keys.
+func ParseOpenSSHSkey(data []byte, password []byte) (*Skey, error) {
+	key, err := ssh.ParseRawPrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var edSkey ed25519.PrivateKey
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		edSkey = k
+	case *ed25519.PrivateKey:
+		edSkey = *k
+	default:
+		return nil, errors.New("Not an ssh-ed25519 key")
+	}
+	return importEdSkey(edSkey, importKeyID(edSkey[32:]))
+}
+
+// SSHSignature is a detached signature in the format of ssh-keygen -Y sign.
+// Namespace separates signatures made for different purposes, e.g. "file"
+// or "git".
+type SSHSignature struct {
+	Pkey      *Pkey
+	Namespace string
+	HashAlg   string
+	Sig       []byte
+}
+
+type sshSigBlob struct {
+	Magic     [6]byte
+	Version   uint32
+	Pkey      []byte
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Sig       []byte
+}
+
+type sshSigSigned struct {
+	Magic     [6]byte
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Hash      []byte
+}
+
+// SignSSH signs the content of r with the sha512 hash, as ssh-keygen does.
+func SignSSH(skey *Skey, r io.Reader, namespace string) (*SSHSignature, error) {
+	if skey.edSkey == nil {
+		return nil, errors.New("Key is locked")
+	}
+	if namespace == "" {
+		return nil, errors.New("Namespace is required")
+	}
+	sig := &SSHSignature{Pkey: skey.GetPkey(), Namespace: namespace, HashAlg: "sha512"}
+	signed, err := sig.signed(r)
+	if err != nil {
+		return nil, err
+	}
+	sig.Sig = skey.Sign(signed)
+	return sig, nil
+}
+
+// Verify checks sig over the content of r. The key in the signature must be
+// pkey and the namespace must match.
+func (sig *SSHSignature) Verify(pkey *Pkey, r io.Reader, namespace string) error {
+	if sig.Namespace != namespace {
+		return errors.New("Signature namespace doesn't match")
+	}
+	if !bytes.Equal(sig.Pkey.Ed.Pkey, pkey.Ed.Pkey) {
+		return errors.New("Signature key doesn't match")
+	}
+	signed, err := sig.signed(r)
+	if err != nil {
+		return err
+	}
+	return pkey.Verify(signed, sig.Sig)
+}
+
+func (sig *SSHSignature) signed(r io.Reader) ([]byte, error) {
+	var h hash.Hash
+	switch sig.HashAlg {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, errors.New("Unsupported signature hash")
+	}
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	signed := sshSigSigned{Namespace: sig.Namespace, HashAlg: sig.HashAlg, Hash: h.Sum(nil)}
+	copy(signed.Magic[:], sshSigMagic)
+	return ssh.Marshal(signed), nil
+}
+
+// Marshal returns the armored signature.
+func (sig *SSHSignature) Marshal() ([]byte, error) {
+	sshPkey, err := ssh.NewPublicKey(ed25519.PublicKey(sig.Pkey.GetEdKey()[:]))
+	if err != nil {
+		return nil, err
+	}
+	blob := sshSigBlob{
+		Version:   sshSigVersion,
+		Pkey:      sshPkey.Marshal(),
+		Namespace: sig.Namespace,
+		HashAlg:   sig.HashAlg,
+		Sig:       ssh.Marshal(ssh.Signature{Format: ssh.KeyAlgoED25519, Blob: sig.Sig}),
+	}
+	copy(blob.Magic[:], sshSigMagic)
+
+	// ssh-keygen wraps the base64 at 70 columns.
+	b64 := base64.StdEncoding.EncodeToString(ssh.Marshal(blob))
+	var out bytes.Buffer
+	out.WriteString("-----BEGIN " + sshSigPEMType + "-----\n")
+	for len(b64) > 70 {
+		out.WriteString(b64[:70] + "\n")
+		b64 = b64[70:]
+	}
+	out.WriteString(b64 + "\n")
+	out.WriteString("-----END " + sshSigPEMType + "-----\n")
+	return out.Bytes(), nil
+}
+
+func ParseSSHSignature(data []byte) (*SSHSignature, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != sshSigPEMType {
+		return nil, errors.New("Bad ssh signature")
+	}
+	blob := sshSigBlob{}
+	err := ssh.Unmarshal(block.Bytes, &blob)
+	if err != nil {
+		return nil, err
+	}
+	if string(blob.Magic[:]) != sshSigMagic || blob.Version != sshSigVersion {
+		return nil, errors.New("Bad ssh signature")
+	}
+	sshPkey, err := ssh.ParsePublicKey(blob.Pkey)
+	if err != nil {
+		return nil, err
+	}
+	pkey, err := importSSHPkey(sshPkey)
+	if err != nil {
+		return nil, err
+	}
+	sshSig := ssh.Signature{}
+	err = ssh.Unmarshal(blob.Sig, &sshSig)
+	if err != nil {
+		return nil, err
+	}
+	if sshSig.Format != ssh.KeyAlgoED25519 || strings.TrimSpace(blob.Namespace) == "" {
+		return nil, errors.New("Bad ssh signature")
+	}
+	return &SSHSignature{Pkey: pkey, Namespace: blob.Namespace, HashAlg: blob.HashAlg, Sig: sshSig.Blob}, nil
+}
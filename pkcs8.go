@@ -0,0 +1,327 @@
+package cryptostack
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Ed25519 and X25519 keys are separate in PKCS#8 and SubjectPublicKeyInfo,
+// so every function here deals with a pair of PEM blocks. The X25519 half
+// of an AlgEd25519 key is the derived one.
+
+const pkcs8Iterations = 600000
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// MarshalPKIX returns the Ed25519 and X25519 halves of pkey as PEM encoded
+// SubjectPublicKeyInfo.
+func (pkey *Pkey) MarshalPKIX() (ed []byte, curve []byte, err error) {
+	curvePkey := pkey.GetCurveKey()
+	if curvePkey == nil {
+		return nil, nil, errors.New("Bad curve25519 public key")
+	}
+	x, err := ecdh.X25519().NewPublicKey(curvePkey[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	ed, err = marshalPEM("PUBLIC KEY", x509.MarshalPKIXPublicKey, ed25519.PublicKey(pkey.GetEdKey()[:]))
+	if err != nil {
+		return nil, nil, err
+	}
+	curve, err = marshalPEM("PUBLIC KEY", x509.MarshalPKIXPublicKey, x)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ed, curve, nil
+}
+
+// ParsePKIX decodes PEM encoded SubjectPublicKeyInfo keys. Without curve, or
+// if curve is the one derived from ed, the result is an AlgEd25519 key.
+func ParsePKIX(ed []byte, curve []byte) (*Pkey, error) {
+	key, err := parsePEM("PUBLIC KEY", x509.ParsePKIXPublicKey, ed)
+	if err != nil {
+		return nil, err
+	}
+	edPkey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("Not an ed25519 key")
+	}
+	pkey := importEdPkey(edPkey, importKeyID(edPkey))
+	if curve == nil {
+		return pkey, nil
+	}
+	key, err = parsePEM("PUBLIC KEY", x509.ParsePKIXPublicKey, curve)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := key.(*ecdh.PublicKey)
+	if !ok || x.Curve() != ecdh.X25519() {
+		return nil, errors.New("Not an x25519 key")
+	}
+	if derived := pkey.GetCurveKey(); derived != nil && bytes.Equal(derived[:], x.Bytes()) {
+		return pkey, nil
+	}
+	curvePkey := &[32]byte{}
+	copy(curvePkey[:], x.Bytes())
+	pkey = NewPkey(curvePkey, pkey.GetEdKey())
+	pkey.ID = importKeyID(edPkey)
+	return pkey, nil
+}
+
+// MarshalPKCS8 returns the Ed25519 and X25519 halves of skey as PEM encoded
+// PKCS#8. With a password they are encrypted with PBES2, using
+// PBKDF2-HMAC-SHA256 and AES-256-CBC.
+func (skey *Skey) MarshalPKCS8(password []byte) (ed []byte, curve []byte, err error) {
+	if skey.edSkey == nil || skey.curveSkey == nil {
+		return nil, nil, errors.New("Key is locked")
+	}
+	x, err := ecdh.X25519().NewPrivateKey(skey.curveSkey[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := [][]byte{}
+	for _, key := range []interface{}{ed25519.PrivateKey(skey.edSkey[:]), x} {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		if len(password) > 0 {
+			block.Type = "ENCRYPTED PRIVATE KEY"
+			block.Bytes, err = encryptPKCS8(der, password)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		keys = append(keys, pem.EncodeToMemory(block))
+	}
+	return keys[0], keys[1], nil
+}
+
+// ParsePKCS8 decodes PEM encoded PKCS#8 keys, encrypted ones are decrypted
+// with password. Without curve the X25519 key is derived from ed.
+func ParsePKCS8(ed []byte, curve []byte, password []byte) (*Skey, error) {
+	key, err := parsePKCS8(ed, password)
+	if err != nil {
+		return nil, err
+	}
+	edSkey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("Not an ed25519 key")
+	}
+	skey, err := importEdSkey(edSkey, importKeyID(edSkey[32:]))
+	if err != nil || curve == nil {
+		return skey, err
+	}
+	key, err = parsePKCS8(curve, password)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := key.(*ecdh.PrivateKey)
+	if !ok || x.Curve() != ecdh.X25519() {
+		return nil, errors.New("Not an x25519 key")
+	}
+	curveSkey := &[32]byte{}
+	copy(curveSkey[:], x.Bytes())
+	curvePkey := &[32]byte{}
+	copy(curvePkey[:], x.PublicKey().Bytes())
+	if bytes.Equal(curvePkey[:], skey.GetPkey().GetCurveKey()[:]) {
+		return skey, nil
+	}
+	pkey := NewPkey(curvePkey, skey.GetPkey().GetEdKey())
+	return newSkey(pkey, curveSkey, skey.edSkey, skey.ID, &skey.Kdf), nil
+}
+
+func parsePKCS8(data []byte, password []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("Bad PEM data")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		der, err := decryptPKCS8(block.Bytes, password)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParsePKCS8PrivateKey(der)
+	}
+	return nil, errors.New("Unexpected PEM type " + block.Type)
+}
+
+func encryptPKCS8(der []byte, password []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	_, err := rand.Read(salt)
+	if err == nil {
+		_, err = rand.Read(iv)
+	}
+	if err != nil {
+		return nil, err
+	}
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pkcs8Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(password, salt, pkcs8Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(append([]byte{}, der...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: data,
+	})
+}
+
+// decryptPKCS8 accepts PBES2 with PBKDF2 and AES-CBC, the scheme used by
+// OpenSSL and Java by default.
+func decryptPKCS8(der []byte, password []byte) ([]byte, error) {
+	info := encryptedPrivateKeyInfo{}
+	_, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New("Unsupported PKCS#8 encryption")
+	}
+	params := pbes2Params{}
+	_, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, errors.New("Unsupported PKCS#8 kdf")
+	}
+	kdf := pbkdf2Params{}
+	_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+	if err != nil {
+		return nil, err
+	}
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil || kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA512):
+		prf = sha512.New
+	default:
+		return nil, errors.New("Unsupported PKCS#8 kdf")
+	}
+	var keyLen int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLen = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, errors.New("Unsupported PKCS#8 cipher")
+	}
+	if kdf.IterationCount < 1 || kdf.IterationCount > 10000000 || (kdf.KeyLength != 0 && kdf.KeyLength != keyLen) {
+		return nil, errors.New("Bad kdf parameters")
+	}
+	var iv []byte
+	_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil {
+		return nil, err
+	}
+	data := info.EncryptedData
+	if len(iv) != aes.BlockSize || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("Bad encrypted PKCS#8 key")
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(password, kdf.Salt, kdf.IterationCount, keyLen, prf))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	// A wrong password shows up as bad padding or, rarely, as a DER error
+	// in the caller.
+	pad := int(out[len(out)-1])
+	if pad < 1 || pad > aes.BlockSize || !hmac.Equal(out[len(out)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("Wrong password for PKCS#8 key")
+	}
+	return out[:len(out)-pad], nil
+}
+
+func marshalPEM(typ string, marshal func(interface{}) ([]byte, error), key interface{}) ([]byte, error) {
+	der, err := marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), nil
+}
+
+func parsePEM(typ string, parse func([]byte) (interface{}, error), data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != typ {
+		return nil, errors.New("Bad PEM data")
+	}
+	return parse(block.Bytes)
+}
@@ -1,6 +1,9 @@
 package ppe
 
+import "github.com/ArtemKulyabin/cryptostack/internal/secmem"
+
 func zero(mem *[32]byte) {
-	var z [32]byte
-	copy(mem[:], z[:])
+	if mem != nil {
+		secmem.Wipe(mem[:])
+	}
 }
@@ -0,0 +1,39 @@
+package cryptostack
+
+import (
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Seal anonymously encrypts message to the curve key of pkey. The result is
+// compatible with libsodium's crypto_box_seal.
+func (pkey *Pkey) Seal(message []byte) ([]byte, error) {
+	err := pkey.CheckUsage(UsageEncrypt)
+	if err != nil {
+		return nil, err
+	}
+	curvePkey := pkey.GetCurveKey()
+	if curvePkey == nil {
+		return nil, errors.New("Bad curve25519 public key")
+	}
+	return box.SealAnonymous(nil, message, curvePkey, rand.Reader)
+}
+
+// OpenSealed decrypts a message produced by Pkey.Seal or crypto_box_seal.
+// A locked skey is used through the agent named by AgentSockEnv.
+func (skey *Skey) OpenSealed(sealed []byte) ([]byte, error) {
+	if skey.curveSkey == nil || skey.pkey == nil {
+		return agentOpen(skey, sealed)
+	}
+	curvePkey := skey.pkey.GetCurveKey()
+	if curvePkey == nil {
+		return nil, errors.New("Bad curve25519 public key")
+	}
+	message, ok := box.OpenAnonymous(nil, sealed, curvePkey, skey.curveSkey)
+	if !ok {
+		return nil, errors.New("Open failed")
+	}
+	return message, nil
+}
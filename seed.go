@@ -0,0 +1,91 @@
+package cryptostack
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"strings"
+
+	"github.com/dchest/blake2b"
+	"github.com/tyler-smith/go-bip39"
+)
+
+const SeedSize = 32
+
+func GenerateSeed() ([]byte, error) {
+	seed := make([]byte, SeedSize)
+	_, err := rand.Read(seed)
+	if err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+// GenerateKeyFromSeed deterministically derives both keypairs and the key ID
+// from seed, so the same seed always restores the same Skey.
+func GenerateKeyFromSeed(seed []byte, kdf *Kdf) (*Skey, error) {
+	if len(seed) != SeedSize {
+		return nil, errors.New("Bad seed size")
+	}
+	curveSeed, err := deriveSeed(seed, "curve25519", 32)
+	if err != nil {
+		return nil, err
+	}
+	edSeed, err := deriveSeed(seed, "ed25519", 32)
+	if err != nil {
+		return nil, err
+	}
+	id, err := deriveSeed(seed, "id", 8)
+	if err != nil {
+		return nil, err
+	}
+	return generateKey(bytes.NewReader(curveSeed), bytes.NewReader(edSeed), id, kdf)
+}
+
+// GenerateEdKeyFromSeed is GenerateKeyFromSeed for AlgEd25519 keys.
+func GenerateEdKeyFromSeed(seed []byte, kdf *Kdf) (*Skey, error) {
+	if len(seed) != SeedSize {
+		return nil, errors.New("Bad seed size")
+	}
+	edSeed, err := deriveSeed(seed, "ed25519", 32)
+	if err != nil {
+		return nil, err
+	}
+	id, err := deriveSeed(seed, "id", 8)
+	if err != nil {
+		return nil, err
+	}
+	return generateEdKey(bytes.NewReader(edSeed), id, kdf)
+}
+
+func deriveSeed(seed []byte, purpose string, size uint8) ([]byte, error) {
+	hash, err := blake2b.New(&blake2b.Config{
+		Size:   size,
+		Key:    seed,
+		Person: []byte("cryptostack-seed"),
+		Salt:   []byte(purpose),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum([]byte{}), nil
+}
+
+// SeedToMnemonic encodes a seed as a BIP-39 English recovery phrase.
+func SeedToMnemonic(seed []byte) (string, error) {
+	if len(seed) != SeedSize {
+		return "", errors.New("Bad seed size")
+	}
+	return bip39.NewMnemonic(seed)
+}
+
+func MnemonicToSeed(mnemonic string) ([]byte, error) {
+	seed, err := bip39.EntropyFromMnemonic(strings.Join(strings.Fields(strings.ToLower(mnemonic)), " "))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != SeedSize {
+		return nil, errors.New("Bad seed size")
+	}
+	return seed, nil
+}
@@ -0,0 +1,313 @@
+package cryptostack
+
+import (
+	"bytes"
+	stded25519 "crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ArtemKulyabin/cryptostack/internal/secmem"
+	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/curve25519"
+)
+
+// shareVersion 2 adds the key metadata to the text of a share.
+const shareVersion = 2
+
+var shareAlgs = []string{AlgCurveEd, AlgEd25519}
+
+// Share is one of the Shamir shares of the secret halves of a key, any
+// Threshold shares of a split give back the key. The secret is shared byte
+// by byte over GF(2^8), Index is the x coordinate of the share. Pkey holds
+// the Curve25519 and Ed25519 public keys, the combined key is checked
+// against them. Meta is the signed metadata of the key, CombineShares
+// restores it.
+type Share struct {
+	Alg       string   `json:"alg"`
+	ID        []byte   `json:"id"`
+	Threshold int      `json:"threshold"`
+	Index     int      `json:"index"`
+	Pkey      []byte   `json:"pkey"`
+	Meta      *KeyMeta `json:"meta,omitempty"`
+	Value     []byte   `json:"value"`
+	Checksum  []byte   `json:"checksum"`
+}
+
+// Split shares the secret halves of an unlocked skey into n shares, any
+// threshold of them are needed to combine the key.
+func (skey *Skey) Split(threshold, n int) ([]*Share, error) {
+	if !skey.unlocked() {
+		return nil, errors.New("Key is locked")
+	}
+	if threshold < 1 || n < threshold || n > 255 {
+		return nil, errors.New("Bad share threshold or count")
+	}
+	secret := make([]byte, 0, 64)
+	secret = append(secret, skey.curveSkey[:]...)
+	secret = append(secret, skey.edSkey[:32]...)
+	defer secmem.Wipe(secret)
+
+	// coeffs[i] holds the coefficients of degree 1 to threshold-1 of the
+	// polynomial sharing secret[i].
+	coeffs := make([]byte, len(secret)*(threshold-1))
+	defer secmem.Wipe(coeffs)
+	_, err := rand.Read(coeffs)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := make([]*Share, n)
+	for x := 1; x <= n; x++ {
+		share := &Share{
+			Alg:       skey.Alg,
+			ID:        append([]byte{}, skey.ID...),
+			Threshold: threshold,
+			Index:     x,
+			Pkey:      append(append([]byte{}, skey.Curve.Pkey...), skey.Ed.Pkey...),
+			Meta:      skey.Meta.clone(),
+			Value:     make([]byte, len(secret)),
+		}
+		for i := range secret {
+			// Horner's rule from the highest coefficient.
+			var y byte
+			for k := threshold - 2; k >= 0; k-- {
+				y = gfMul(y, byte(x)) ^ coeffs[i*(threshold-1)+k]
+			}
+			share.Value[i] = gfMul(y, byte(x)) ^ secret[i]
+		}
+		share.Checksum = share.checksum()
+		shares[x-1] = share
+	}
+	return shares, nil
+}
+
+// CombineShares interpolates the secret halves from at least Threshold
+// shares of the same split and returns the unlocked key with its metadata.
+func CombineShares(shares []*Share) (*Skey, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("No shares")
+	}
+	first := shares[0]
+	seen := map[int]bool{}
+	for _, share := range shares {
+		err := share.check()
+		if err != nil {
+			return nil, err
+		}
+		if share.Alg != first.Alg || !bytes.Equal(share.ID, first.ID) || share.Threshold != first.Threshold ||
+			!bytes.Equal(share.Pkey, first.Pkey) || !bytes.Equal(share.metaData(), first.metaData()) ||
+			len(share.Value) != len(first.Value) {
+			return nil, errors.New("Shares of different keys")
+		}
+		if seen[share.Index] {
+			return nil, errors.New("Duplicate share")
+		}
+		seen[share.Index] = true
+	}
+	if len(shares) < first.Threshold {
+		return nil, fmt.Errorf("%d shares needed, got %d", first.Threshold, len(shares))
+	}
+
+	// Lagrange interpolation at x = 0, subtraction is xor in GF(2^8).
+	secret := make([]byte, len(first.Value))
+	defer secmem.Wipe(secret)
+	for i, share := range shares {
+		xi := byte(share.Index)
+		l := byte(1)
+		for j, other := range shares {
+			if i != j {
+				xj := byte(other.Index)
+				l = gfMul(l, gfMul(xj, gfInv(xj^xi)))
+			}
+		}
+		for k, y := range share.Value {
+			secret[k] ^= gfMul(y, l)
+		}
+	}
+
+	curveSkey, edSkey := &[32]byte{}, &[64]byte{}
+	copy(curveSkey[:], secret[:32])
+	copy(edSkey[:], stded25519.NewKeyFromSeed(secret[32:]))
+	curvePkey, err := curve25519.X25519(curveSkey[:], curve25519.Basepoint)
+	if err != nil || !bytes.Equal(curvePkey, first.Pkey[:32]) || !bytes.Equal(edSkey[32:], first.Pkey[32:]) ||
+		(first.Alg == AlgEd25519 && *EdSkeyToCurve(edSkey) != *curveSkey) {
+		secmem.Wipe(curveSkey[:])
+		secmem.Wipe(edSkey[:])
+		return nil, errors.New("Shares don't give the key")
+	}
+	kdf, err := NewKdf(KdfPbkdf2Blake2b)
+	if err != nil {
+		return nil, err
+	}
+	edPkey := &[32]byte{}
+	copy(edPkey[:], first.Pkey[32:])
+	var pkey *Pkey
+	if first.Alg == AlgEd25519 {
+		pkey = NewEdPkey(edPkey)
+	} else {
+		pkey = NewPkey(&[32]byte{}, edPkey)
+		copy(pkey.Curve.Pkey, curvePkey)
+	}
+	skey := newSkey(pkey, curveSkey, edSkey, append([]byte{}, first.ID...), kdf)
+	if first.Meta != nil {
+		meta := first.Meta.clone()
+		if pkey.verifyContext(meta.signedData(pkey), meta.Sig, ContextKeyMeta) != nil {
+			skey.Wipe()
+			return nil, errors.New("Bad key metadata signature")
+		}
+		skey.Meta, pkey.Meta = meta, meta
+	}
+	return skey, nil
+}
+
+// metaData is the encoding of Meta in the checksum and the text of a
+// share, nil without metadata.
+func (share *Share) metaData() []byte {
+	if share.Meta == nil {
+		return nil
+	}
+	data, _ := json.Marshal(share.Meta)
+	return data
+}
+
+func (share *Share) checksum() []byte {
+	var data bytes.Buffer
+	fields := [][]byte{[]byte("cryptostack share"), []byte(share.Alg), share.ID,
+		{byte(share.Threshold), byte(share.Index)}, share.Pkey, share.Value}
+	// Shares without metadata keep the checksum of version 1.
+	if share.Meta != nil {
+		fields = append(fields, share.metaData())
+	}
+	writeFields(&data, fields)
+	sum := blake2b.Sum256(data.Bytes())
+	return sum[:4]
+}
+
+func (share *Share) check() error {
+	if share.Threshold < 1 || share.Index < 1 || share.Index > 255 || share.Threshold > 255 ||
+		len(share.Pkey) != 64 || len(share.Value) != 64 || len(share.ID) > 255 {
+		return errors.New("Bad share")
+	}
+	if subtle.ConstantTimeCompare(share.Checksum, share.checksum()) != 1 {
+		return errors.New("Bad share checksum")
+	}
+	return nil
+}
+
+// Text renders share for printing: a header line followed by the share in
+// base32, in groups of four characters.
+func (share *Share) Text() string {
+	alg := 0
+	for i, a := range shareAlgs {
+		if a == share.Alg {
+			alg = i
+		}
+	}
+	var data bytes.Buffer
+	data.Write([]byte{shareVersion, byte(alg), byte(share.Threshold), byte(share.Index), byte(len(share.ID))})
+	data.Write(share.ID)
+	data.Write(share.Pkey)
+	data.Write(share.Value)
+	meta := share.metaData()
+	binary.Write(&data, binary.BigEndian, uint16(len(meta)))
+	data.Write(meta)
+	data.Write(share.Checksum)
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(data.Bytes())
+
+	text := fmt.Sprintf("cryptostack share %d of key %s, %d needed\n", share.Index, hex.EncodeToString(share.ID), share.Threshold)
+	for i := 0; i < len(encoded); i += 4 {
+		end := i + 4
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		text += encoded[i:end]
+		if end == len(encoded) || (i/4)%8 == 7 {
+			text += "\n"
+		} else {
+			text += " "
+		}
+	}
+	return text
+}
+
+// ParseShare reads a share written by Text, or by Text of version 1 without
+// metadata. The header line is optional, case and spacing of the base32
+// lines don't matter.
+func ParseShare(text string) (*Share, error) {
+	var encoded string
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if strings.HasPrefix(line, "cryptostack share") {
+			continue
+		}
+		encoded += strings.ToUpper(strings.Join(strings.Fields(line), ""))
+	}
+	data, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 5 || data[0] < 1 || data[0] > shareVersion || int(data[1]) >= len(shareAlgs) {
+		return nil, errors.New("Bad share")
+	}
+	version := data[0]
+	share := &Share{Alg: shareAlgs[data[1]], Threshold: int(data[2]), Index: int(data[3])}
+	idLen := int(data[4])
+	data = data[5:]
+	if len(data) < idLen+64+64 {
+		return nil, errors.New("Bad share")
+	}
+	share.ID, data = data[:idLen], data[idLen:]
+	share.Pkey, data = data[:64], data[64:]
+	share.Value, data = data[:64], data[64:]
+	if version >= 2 {
+		if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+			return nil, errors.New("Bad share")
+		}
+		metaLen := int(binary.BigEndian.Uint16(data))
+		if metaLen > 0 {
+			share.Meta = &KeyMeta{}
+			err = json.Unmarshal(data[2:2+metaLen], share.Meta)
+			if err != nil {
+				return nil, errors.New("Bad share metadata")
+			}
+		}
+		data = data[2+metaLen:]
+	}
+	if len(data) != 4 {
+		return nil, errors.New("Bad share")
+	}
+	share.Checksum = data
+	err = share.check()
+	if err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, without branches on
+// secret values.
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		a = a<<1 ^ -(a>>7)&0x1b
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns a^254, the inverse of a non-zero a.
+func gfInv(a byte) byte {
+	r := a
+	for i := 0; i < 6; i++ {
+		a = gfMul(a, a)
+		r = gfMul(r, a)
+	}
+	return gfMul(r, r)
+}
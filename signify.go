@@ -0,0 +1,129 @@
+package cryptostack
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dchest/bcrypt_pbkdf"
+)
+
+const (
+	signifyAlg    = "Ed"
+	signifyKdfAlg = "BK"
+	signifyRounds = 42
+)
+
+// MarshalSignify encodes the Ed25519 half of pkey as an OpenBSD signify
+// public key. Pkey.ID is used as the signify key number.
+func (pkey *Pkey) MarshalSignify() ([]byte, error) {
+	if len(pkey.ID) != 8 {
+		return nil, errors.New("Key ID must be 8 bytes")
+	}
+	raw := append([]byte(signifyAlg), pkey.ID...)
+	raw = append(raw, pkey.GetEdKey()[:]...)
+	return encodeTextKey("signify public key", raw), nil
+}
+
+// ParseSignifyPkey decodes a signify public key. The result is an
+// AlgEd25519 key.
+func ParseSignifyPkey(data []byte) (*Pkey, error) {
+	_, raw, err := decodeTextKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 2+8+32 || string(raw[:2]) != signifyAlg {
+		return nil, errors.New("Bad signify public key")
+	}
+	return importEdPkey(raw[10:], raw[2:10]), nil
+}
+
+// MarshalSignify encodes the Ed25519 half of skey as a signify secret key
+// encrypted with password, or unencrypted if password is empty.
+func (skey *Skey) MarshalSignify(password []byte) ([]byte, error) {
+	if skey.edSkey == nil {
+		return nil, errors.New("Key is locked")
+	}
+	if len(skey.ID) != 8 {
+		return nil, errors.New("Key ID must be 8 bytes")
+	}
+	raw := make([]byte, 2+2+4+16+8, 2+2+4+16+8+8+64)
+	copy(raw, signifyAlg)
+	copy(raw[2:], signifyKdfAlg)
+	checksum := sha512.Sum512(skey.edSkey[:])
+	copy(raw[24:], checksum[:8])
+	raw = append(raw, skey.ID...)
+	raw = append(raw, skey.edSkey[:]...)
+	if len(password) > 0 {
+		binary.BigEndian.PutUint32(raw[4:], signifyRounds)
+		_, err := rand.Read(raw[8:24])
+		if err != nil {
+			return nil, err
+		}
+		err = signifyXor(raw[40:], password, raw[8:24], signifyRounds)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encodeTextKey("signify secret key", raw), nil
+}
+
+func ParseSignifySkey(data []byte, password []byte) (*Skey, error) {
+	_, raw, err := decodeTextKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 2+2+4+16+8+8+64 || string(raw[:2]) != signifyAlg || string(raw[2:4]) != signifyKdfAlg {
+		return nil, errors.New("Bad signify secret key")
+	}
+	rounds := binary.BigEndian.Uint32(raw[4:])
+	if rounds > 0 {
+		err = signifyXor(raw[40:], password, raw[8:24], int(rounds))
+		if err != nil {
+			return nil, err
+		}
+	}
+	checksum := sha512.Sum512(raw[40:])
+	if subtle.ConstantTimeCompare(checksum[:8], raw[24:32]) != 1 {
+		return nil, errors.New("Wrong password for signify secret key")
+	}
+	return importEdSkey(raw[40:], raw[32:40])
+}
+
+func signifyXor(data, password, salt []byte, rounds int) error {
+	stream, err := bcrypt_pbkdf.Key(password, salt, rounds, len(data))
+	if err != nil {
+		return err
+	}
+	for i := range data {
+		data[i] ^= stream[i]
+	}
+	return nil
+}
+
+// SignSignify returns a signify signature file for message, comment is
+// put in its untrusted comment line.
+func SignSignify(skey *Skey, message []byte, comment string) ([]byte, error) {
+	if skey.edSkey == nil {
+		return nil, errors.New("Key is locked")
+	}
+	raw := append([]byte(signifyAlg), skey.ID...)
+	raw = append(raw, skey.Sign(message)...)
+	return encodeTextKey(comment, raw), nil
+}
+
+func VerifySignify(pkey *Pkey, message []byte, sig []byte) error {
+	_, raw, err := decodeTextKey(sig)
+	if err != nil {
+		return err
+	}
+	if len(raw) != 2+8+64 || string(raw[:2]) != signifyAlg {
+		return errors.New("Bad signify signature")
+	}
+	if subtle.ConstantTimeCompare(raw[2:10], pkey.ID) != 1 {
+		return errors.New("Signature key ID doesn't match")
+	}
+	return pkey.Verify(message, raw[10:])
+}
@@ -0,0 +1,176 @@
+package cryptostack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	StatementRevoke = "revoke"
+	StatementRotate = "rotate"
+)
+
+// KeyStatement is a statement about Pkey signed by the key itself: either
+// it is revoked, or it is retired in favour of NewPkey.
+type KeyStatement struct {
+	Alg     string `json:"alg"`
+	Type    string `json:"type"`
+	Pkey    *Pkey  `json:"pkey"`
+	NewPkey *Pkey  `json:"newpkey,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Created int64  `json:"created"`
+	Sig     []byte `json:"sig"`
+}
+
+func NewRevocation(skey *Skey, reason string) (*KeyStatement, error) {
+	st := &KeyStatement{Type: StatementRevoke, Reason: reason}
+	return st, st.sign(skey)
+}
+
+func NewRotation(skey *Skey, newPkey *Pkey) (*KeyStatement, error) {
+	st := &KeyStatement{Type: StatementRotate, NewPkey: newPkey}
+	return st, st.sign(skey)
+}
+
+func (st *KeyStatement) sign(skey *Skey) error {
+	if skey.edSkey == nil || skey.pkey == nil {
+		return errors.New("Key is locked")
+	}
+	st.Alg = SigAlgEd25519ctx
+	st.Pkey = skey.GetPkey()
+	st.Created = time.Now().Unix()
+	var err error
+	st.Sig, err = skey.SignWithContext(st.signedData(), SigAlgEd25519ctx, ContextStatement)
+	return err
+}
+
+func (st *KeyStatement) Verify() error {
+	if st.Alg != SigAlgEd25519ctx {
+		return errors.New("Unsupported statement algorithm")
+	}
+	if st.Pkey == nil {
+		return errors.New("Statement has no key")
+	}
+	switch st.Type {
+	case StatementRevoke:
+	case StatementRotate:
+		if st.NewPkey == nil {
+			return errors.New("Rotation has no new key")
+		}
+	default:
+		return errors.New("Unknown statement type")
+	}
+	return st.Pkey.verifyContext(st.signedData(), st.Sig, ContextStatement)
+}
+
+func (st *KeyStatement) signedData() []byte {
+	var data bytes.Buffer
+	fields := [][]byte{[]byte("cryptostack key statement"), []byte(st.Alg), []byte(st.Type), []byte(st.Reason)}
+	fields = append(fields, pkeyFields(st.Pkey)...)
+	fields = append(fields, pkeyFields(st.NewPkey)...)
+	writeFields(&data, fields)
+	binary.Write(&data, binary.BigEndian, st.Created)
+	return data.Bytes()
+}
+
+// writeFields writes length prefixed values, the encoding of everything
+// signed besides messages.
+func writeFields(data *bytes.Buffer, fields [][]byte) {
+	for _, v := range fields {
+		binary.Write(data, binary.BigEndian, uint32(len(v)))
+		data.Write(v)
+	}
+}
+
+func pkeyFields(pkey *Pkey) [][]byte {
+	if pkey == nil {
+		return [][]byte{nil, nil, nil, nil}
+	}
+	return [][]byte{[]byte(pkey.Alg), pkey.ID, pkey.Curve.Pkey, pkey.Ed.Pkey}
+}
+
+func samePkey(a, b *Pkey) bool {
+	return a.Alg == b.Alg && bytes.Equal(a.Ed.Pkey, b.Ed.Pkey) && bytes.Equal(a.Curve.Pkey, b.Curve.Pkey)
+}
+
+// Revocations is a set of verified key statements. Keys are matched by
+// their Ed25519 public key, not by ID, since IDs are not signed.
+type Revocations struct {
+	mu      sync.RWMutex
+	revoked map[string]*KeyStatement
+	rotated map[string]*KeyStatement
+}
+
+func NewRevocations() *Revocations {
+	return &Revocations{
+		revoked: map[string]*KeyStatement{},
+		rotated: map[string]*KeyStatement{},
+	}
+}
+
+func (rv *Revocations) Add(st *KeyStatement) error {
+	err := st.Verify()
+	if err != nil {
+		return err
+	}
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	key := string(st.Pkey.GetEdKey()[:])
+	if st.Type == StatementRevoke {
+		rv.revoked[key] = st
+	} else {
+		rv.rotated[key] = st
+	}
+	return nil
+}
+
+// Check returns ErrKeyRevoked or ErrKeyRetired if pkey must not be trusted.
+func (rv *Revocations) Check(pkey *Pkey) error {
+	rv.mu.RLock()
+	defer rv.mu.RUnlock()
+	key := string(pkey.GetEdKey()[:])
+	if _, ok := rv.revoked[key]; ok {
+		return ErrKeyRevoked
+	}
+	if _, ok := rv.rotated[key]; ok {
+		return ErrKeyRetired
+	}
+	return nil
+}
+
+// Successor follows rotation statements from pkey and returns the newest
+// key, or nil if pkey was not rotated.
+func (rv *Revocations) Successor(pkey *Pkey) *Pkey {
+	rv.mu.RLock()
+	defer rv.mu.RUnlock()
+	var successor *Pkey
+	seen := map[string]bool{}
+	for {
+		key := string(pkey.GetEdKey()[:])
+		st, ok := rv.rotated[key]
+		if !ok || seen[key] {
+			return successor
+		}
+		seen[key] = true
+		successor = st.NewPkey
+		pkey = st.NewPkey
+	}
+}
+
+// Verify checks the signing key of sig against the set before verifying sig.
+func (rv *Revocations) Verify(sig *Signature, r io.Reader) (*SignatureMeta, error) {
+	return rv.VerifyContext(sig, r, ContextFile)
+}
+
+// VerifyContext is Verify for signatures made for context.
+func (rv *Revocations) VerifyContext(sig *Signature, r io.Reader, context string) (*SignatureMeta, error) {
+	err := rv.Check(sig.Pkey)
+	if err != nil {
+		return nil, err
+	}
+	return sig.VerifyContext(r, context)
+}
@@ -0,0 +1,246 @@
+package cryptostack
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	StreamAlg       = "x25519-chacha20poly1305-stream"
+	StreamChunkSize = 64 * 1024
+
+	maxStreamChunkSize  = 1024 * 1024
+	maxStreamHeaderSize = 64 * 1024
+)
+
+// The stream starts with a json header line. It carries a random file key
+// sealed to every recipient, the payload key is a keyed blake2b of the header
+// line under the file key, so the header can't be changed either. The payload
+// follows as ChunkSize pieces of plaintext, each sealed with ChaCha20-Poly1305
+// under a nonce made of a chunk counter and a flag marking the last chunk.
+type streamHeader struct {
+	Alg        string            `json:"alg"`
+	ChunkSize  int               `json:"chunksize"`
+	Recipients []streamRecipient `json:"recipients"`
+}
+
+type streamRecipient struct {
+	ID  []byte `json:"id"`
+	Key []byte `json:"key"`
+}
+
+type streamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	size    int
+	counter uint64
+	err     error
+}
+
+// NewStreamWriter returns a writer that encrypts everything written to it
+// for recipients and writes the result to w. Close must be called to write
+// the final chunk, it does not close w.
+func NewStreamWriter(w io.Writer, recipients []*Pkey) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("No recipients")
+	}
+	fileKey := make([]byte, chacha20poly1305.KeySize)
+	_, err := rand.Read(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	header := streamHeader{Alg: StreamAlg, ChunkSize: StreamChunkSize}
+	for _, pkey := range recipients {
+		key, err := pkey.Seal(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		header.Recipients = append(header.Recipients, streamRecipient{ID: pkey.ID, Key: key})
+	}
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := streamAEAD(fileKey, line)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(append(line, '\n'))
+	if err != nil {
+		return nil, err
+	}
+	return &streamWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, header.ChunkSize+aead.Overhead()),
+		size: header.ChunkSize,
+	}, nil
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	total := 0
+	for len(p) > 0 {
+		// A full chunk is kept until more data comes, so that Close
+		// can still mark it as the last one.
+		if len(sw.buf) == sw.size {
+			err := sw.flush(false)
+			if err != nil {
+				sw.err = err
+				return total, err
+			}
+		}
+		n := copy(sw.buf[len(sw.buf):sw.size], p)
+		sw.buf = sw.buf[:len(sw.buf)+n]
+		p = p[n:]
+		total += n
+	}
+	return total, nil
+}
+
+func (sw *streamWriter) Close() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	err := sw.flush(true)
+	if err != nil {
+		sw.err = err
+		return err
+	}
+	sw.err = errors.New("Stream is closed")
+	return nil
+}
+
+func (sw *streamWriter) flush(last bool) error {
+	chunk := sw.aead.Seal(sw.buf[:0], streamNonce(sw.counter, last), sw.buf, nil)
+	sw.buf = sw.buf[:0]
+	sw.counter++
+	_, err := sw.w.Write(chunk)
+	return err
+}
+
+type streamReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	out     []byte
+	counter uint64
+	last    bool
+	err     error
+}
+
+// NewStreamReader returns a reader of the plaintext of a stream written by
+// NewStreamWriter to one of the public keys of skey. Data is returned only
+// after its chunk has been authenticated; a stream cut off before the last
+// chunk results in an error instead of io.EOF.
+func NewStreamReader(r io.Reader, skey *Skey) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, maxStreamHeaderSize)
+	line, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errors.New("Stream header is too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	header := streamHeader{}
+	err = json.Unmarshal(line, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != StreamAlg {
+		return nil, errors.New("Unsupported stream algorithm")
+	}
+	if header.ChunkSize < 1 || header.ChunkSize > maxStreamChunkSize {
+		return nil, errors.New("Bad stream chunk size")
+	}
+	var fileKey []byte
+	for _, recipient := range header.Recipients {
+		fileKey, err = skey.OpenSealed(recipient.Key)
+		if err == nil {
+			break
+		}
+	}
+	if fileKey == nil {
+		return nil, errors.New("Stream is not encrypted to this key")
+	}
+	aead, err := streamAEAD(fileKey, line)
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{
+		r:    br,
+		aead: aead,
+		buf:  make([]byte, header.ChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	for len(sr.out) == 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		sr.err = sr.next()
+	}
+	n := copy(p, sr.out)
+	sr.out = sr.out[n:]
+	return n, nil
+}
+
+func (sr *streamReader) next() error {
+	if sr.last {
+		return io.EOF
+	}
+	n, err := io.ReadFull(sr.r, sr.buf)
+	switch err {
+	case nil:
+		_, err = sr.r.Peek(1)
+		if err == io.EOF {
+			sr.last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		sr.last = true
+	case io.EOF:
+		return errors.New("Stream is truncated")
+	default:
+		return err
+	}
+	out, err := sr.aead.Open(sr.buf[:0], streamNonce(sr.counter, sr.last), sr.buf[:n], nil)
+	if err != nil {
+		return errors.New("Stream is corrupted or truncated")
+	}
+	sr.out = out
+	sr.counter++
+	return nil
+}
+
+func streamAEAD(fileKey []byte, header []byte) (cipher.AEAD, error) {
+	hash, err := blake2b.New(&blake2b.Config{Size: chacha20poly1305.KeySize, Key: fileKey})
+	if err != nil {
+		return nil, err
+	}
+	hash.Write(header)
+	return chacha20poly1305.New(hash.Sum([]byte{}))
+}
+
+func streamNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}